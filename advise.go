@@ -0,0 +1,113 @@
+package cascade
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/zeebo/errs"
+	"github.com/zeebo/mon"
+	"golang.org/x/sys/unix"
+)
+
+//
+// a lookup touches a random page of every level it probes, so on a cold cache
+// every probe is a fault. the smallest levels are probed the most for their
+// size, so they are hot: they are read ahead when mapped and optionally
+// locked in memory. large levels are advised to be random so that a fault
+// does not read ahead pages that the next lookup is unlikely to touch.
+//
+
+// warmSink keeps the reads done by Warm from being optimized away.
+var warmSink uint32
+
+// bySize returns every level, including the frozen and spare levels, from
+// smallest to largest. It must be called with mu held.
+func (c *casFilter) bySize() []level {
+	ls := make([]level, 0, len(c.levels)+2)
+	ls = append(ls, c.levels...)
+	if c.frozen.filter != nil {
+		ls = append(ls, c.frozen)
+	}
+	if c.spare.filter != nil {
+		ls = append(ls, c.spare)
+	}
+	sort.SliceStable(ls, func(i, j int) bool {
+		return len(ls[i].buffer()) < len(ls[j].buffer())
+	})
+	return ls
+}
+
+// hint applies the access hints to every level and returns the hot levels,
+// which are the smallest ones that fit in the hot bytes. It must be called
+// with mu held.
+func (c *casFilter) hint() (hot []level, err error) {
+	keep := func(herr error) {
+		if err == nil {
+			err = herr
+		}
+	}
+
+	budget := c.opts.hotBytes()
+	for _, l := range c.bySize() {
+		buf := l.buffer()
+		size := int64(len(buf))
+
+		if size <= budget {
+			budget -= size
+			hot = append(hot, l)
+			keep(unix.Madvise(buf, unix.MADV_WILLNEED))
+			if c.opts.LockHot {
+				keep(unix.Mlock(buf))
+			}
+			continue
+		}
+
+		advice := unix.MADV_NORMAL
+		if c.opts.RandomBytes > 0 && size >= c.opts.RandomBytes {
+			advice = unix.MADV_RANDOM
+		}
+		keep(unix.Madvise(buf, advice))
+		if c.opts.LockHot {
+			keep(unix.Munlock(buf))
+		}
+	}
+
+	return hot, errs.Wrap(err)
+}
+
+// advise applies the access hints to every level. They are only hints, so
+// any error is ignored here and reported by Warm instead.
+func (c *casFilter) advise() {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	_, _ = c.hint()
+}
+
+// Warm applies the access hints to every level and faults in every page of
+// the hot levels, so that lookups do not fault on them. It returns any error
+// applying the hints, such as being unable to lock the hot levels in memory.
+func (c *casFilter) Warm() (err error) {
+	defer mon.Start().Stop(&err)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.closed {
+		return errs.New("filter closed")
+	}
+
+	hot, err := c.hint()
+
+	// reading the pages faults them in without dirtying them.
+	sum := uint32(0)
+	for _, l := range hot {
+		buf := l.buffer()
+		for i := int64(0); i < int64(len(buf)); i += pageSize() {
+			sum += uint32(buf[i])
+		}
+	}
+	atomic.StoreUint32(&warmSink, sum)
+
+	return errs.Wrap(err)
+}
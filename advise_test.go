@@ -0,0 +1,73 @@
+package cascade
+
+import (
+	"testing"
+
+	"github.com/zeebo/assert"
+	"github.com/zeebo/pcg"
+)
+
+func TestAdvise(t *testing.T) {
+	t.Run("Hot", func(t *testing.T) {
+		cf, done := tempFilter(t, 20, Options{})
+		defer done()
+
+		for len(cf.levels) < 4 {
+			assert.NoError(t, cf.Add(pcg.Uint64()))
+		}
+
+		// levels 0 and 1 are the same size, and the rest are larger.
+		size := int64(len(cf.levels[0].buffer()))
+		for _, c := range []struct {
+			hot int64
+			exp int
+		}{
+			{-1, 0},
+			{size - 1, 0},
+			{size, 1},
+			{2*size + 1, 2},
+			{cf.size, len(cf.levels)},
+		} {
+			cf.opts.HotBytes = c.hot
+			cf.mu.RLock()
+			hot, err := cf.hint()
+			cf.mu.RUnlock()
+			assert.NoError(t, err)
+			assert.Equal(t, len(hot), c.exp)
+		}
+	})
+
+	t.Run("Warm", func(t *testing.T) {
+		for _, opts := range []Options{
+			{HotBytes: 16 << 10, RandomBytes: 8 << 10},
+			{HotBytes: 16 << 10, LockHot: true},
+		} {
+			cf, done := tempFilter(t, 20, opts)
+			defer done()
+
+			for len(cf.levels) < 4 {
+				assert.NoError(t, cf.Add(pcg.Uint64()))
+			}
+			assert.NoError(t, cf.Close())
+
+			cf, err := OpenStorage(cf.st, opts)
+			assert.NoError(t, err)
+			assert.NoError(t, cf.Warm())
+
+			// every page of the hot levels is in memory.
+			cf.mu.RLock()
+			hot, err := cf.hint()
+			cf.mu.RUnlock()
+			assert.NoError(t, err)
+			assert.That(t, len(hot) > 0)
+			for _, l := range hot {
+				n, err := resident(l.buffer())
+				assert.NoError(t, err)
+				assert.Equal(t, n, int64(len(l.buffer())))
+			}
+
+			assert.NoError(t, cf.Close())
+			assert.Error(t, cf.Warm())
+		}
+	})
+}
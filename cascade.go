@@ -1,18 +1,76 @@
 package cascade
 
 import (
+	"context"
+	"errors"
+	"math"
 	"os"
+	"sync"
 
 	"github.com/zeebo/errs"
 	"github.com/zeebo/mon"
 	"golang.org/x/sys/unix"
 )
 
+// ErrFull is returned when the filter would need a level with fewer than the
+// minimum number of remainder bits. The element causing it is not added, but
+// the filter remains usable for lookups and removes.
+var ErrFull = errors.New("cascade: remainder bits exhausted")
+
+// level is a filter along with where it lives in the backing file.
+type level struct {
+	filter
+	off   int64    // offset of the level in the backing file
+	live  bool     // modified without committing the header
+	dirty bool     // empty, but the buffer may not be cleared
+	sum   *summary // fingerprints in the level, or nil to always probe it
+}
+
+// casFilter is safe for concurrent use. Writers are serialized by wmu, and
+// mu is only held for writing while a writer changes something a lookup can
+// observe. In particular, the merge during a spill is done into a level that
+// lookups skip, so lookups proceed against the old levels until the merged
+// level is published.
+//
+// With background spills, the spill goroutine runs without wmu. Writers wait
+// for it to finish before touching anything other than level 0.
 type casFilter struct {
-	fh       *os.File
+	wmu sync.Mutex   // serializes writers
+	mu  sync.RWMutex // protects the levels from lookups
+
+	st       Storage
+	ms       manifestStorage // set if the header is kept in a manifest
+	opts     Options
+	hasher   Hasher
+	layout   Layout
+	counting bool
+	vbits    uint // bits of the value stored with every hash
 	q, r     uint
-	levels   []*quoFil
+	gen      uint64
+	size     int64
+	hdr      []byte
+	levels   []level
+	changes  uint64 // counts changes to the levels so that iterators reload
 	mappings [][]byte
+	broken   error
+	closed   bool
+
+	unused   []level  // discarded buffers that alloc may reuse
+	spare    level    // empty buffer to swap with level 0
+	frozen   level    // full level 0 being spilled in the background
+	spilling *bgSpill // the running background spill, if any
+
+	summarizing chan struct{} // closed once the opened levels are summarized
+
+	// step is called at every point in a spill or remove where a crash would
+	// leave the file in a different state. tests use it to interrupt them.
+	step func() error
+}
+
+// bgSpill is a spill running in the background.
+type bgSpill struct {
+	done chan struct{} // closed when the spill is done
+	err  error         // the result of the spill, set before done is closed
 }
 
 var New = newCasFil
@@ -20,156 +78,1291 @@ var New = newCasFil
 type Filter = casFilter
 
 func newCasFil(fh *os.File, bits uint) *casFilter {
-	// pages are assumed to be 4k. the hash is going to be
-	// bits many long. our minimum false positive rate is
-	// a remainder of 5 bits. each element has 3 bits of
-	// overhead. we have 32768 bits in 4k. we want to find
-	// the largest r such that (3+r)*2^q < 32768 with r+q = bits.
+	c, err := NewOptions(fh, bits, Options{})
+	if err != nil {
+		// there is no way to return the error, so every Add returns it.
+		return &casFilter{st: NewFileStorage(fh), hasher: NewHasher(0), broken: err}
+	}
+	return c
+}
+
+// NewOptions is like New but allows specifying options. It returns an error
+// if the options are impossible for the number of hash bits.
+func NewOptions(fh *os.File, bits uint, opts Options) (*casFilter, error) {
+	return NewStorage(NewFileStorage(fh), bits, opts)
+}
 
-	r, vr := uint(0), uint(0)
-	for cr := uint(1); cr < bits; cr++ {
-		if cv := (3 + cr) * (1 << (bits - cr)); cv < 32768 && cv > vr {
-			r, vr = cr, cv
+// NewStorage is like NewOptions but keeps the filter in the storage, which
+// should be empty.
+func NewStorage(st Storage, bits uint, opts Options) (*casFilter, error) {
+	q, r, err := opts.geometry(bits)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+
+	ms, _ := st.(manifestStorage)
+	c := &casFilter{
+		st:       st,
+		ms:       ms,
+		opts:     opts,
+		hasher:   opts.hasher(),
+		layout:   opts.Layout,
+		counting: opts.Counting,
+		vbits:    opts.ValueBits,
+		q:        q,
+		r:        r,
+	}
+
+	// level 0 is committed right away so that the settings are recorded even
+	// if the filter is closed before anything is added.
+	if err := c.newLevel(); err != nil {
+		c.unmap()
+		return nil, errs.Wrap(err)
+	}
+	return c, nil
+}
+
+// NewForCapacity returns a filter sized to hold the expected number of items
+// with about the target false positive rate. Every fingerprint in a level
+// collides with a random hash with probability 2^-bits, so the rate after n
+// items is about n/2^bits. The hash bits are also chosen so that the cascade
+// has enough levels to hold the items before running out of remainder bits.
+func NewForCapacity(fh *os.File, items uint64, fpr float64) (*casFilter, error) {
+	if items == 0 {
+		return nil, errs.New("invalid expected items: %d", items)
+	}
+	if fpr <= 0 || fpr >= 1 || math.IsNaN(fpr) {
+		return nil, errs.New("invalid false positive rate: %v", fpr)
+	}
+
+	var opts Options
+
+	// the deepest level has at least 2^(bits-min) slots, and it must be
+	// able to hold all of the items at the load factor.
+	bits := math.Ceil(math.Log2(float64(items) / fpr))
+	need := math.Ceil(math.Log2(float64(items)/opts.loadFactor())) + float64(opts.minRemainder())
+	bits = math.Max(bits, need)
+	if bits > 64 {
+		return nil, errs.New("%d items at false positive rate %v needs %v hash bits",
+			items, fpr, bits)
+	}
+
+	return NewOptions(fh, uint(bits), opts)
+}
+
+// Open returns a filter backed by fh, which must have been written by a
+// filter returned from New. The levels are mapped in place so that the
+// filter answers lookups the same as when it was written.
+func Open(fh *os.File) (*casFilter, error) {
+	return OpenOptions(fh, Options{})
+}
+
+// OpenOptions is like Open but allows specifying options.
+func OpenOptions(fh *os.File, opts Options) (*casFilter, error) {
+	return OpenStorage(NewFileStorage(fh), opts)
+}
+
+// OpenStorage is like OpenOptions but reads the filter from the storage,
+// which must have been written by a filter returned from NewStorage.
+func OpenStorage(st Storage, opts Options) (_ *casFilter, err error) {
+	defer mon.Start().Stop(&err)
+
+	if err := opts.validate(); err != nil {
+		return nil, errs.Wrap(err)
+	}
+
+	c := &casFilter{st: st, opts: opts}
+	c.ms, _ = st.(manifestStorage)
+	defer func() {
+		if err != nil {
+			c.unmap()
+		}
+	}()
+
+	stSize, err := st.Size()
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	if stSize < pageSize() {
+		return nil, errs.New("file too small to contain a header: %d", stSize)
+	}
+	c.size = pageSize()
+
+	var h header
+	if c.ms != nil {
+		buf, err := c.ms.readManifest()
+		if err != nil {
+			return nil, errs.Wrap(err)
+		}
+		h, err = parseHeader(buf)
+		if err != nil {
+			return nil, errs.Wrap(err)
+		}
+	} else {
+		c.hdr, err = c.mmap(0, pageSize())
+		if err != nil {
+			return nil, errs.Wrap(err)
+		}
+		h, err = readHeader(c.hdr)
+		if err != nil {
+			return nil, errs.Wrap(err)
 		}
 	}
+	if h.pageSize != pageSize() {
+		return nil, errs.New("file page size %d does not match system page size %d",
+			h.pageSize, pageSize())
+	}
 
-	return &casFilter{
-		fh: fh,
-		q:  bits - r,
-		r:  r,
+	switch {
+	case opts.Hasher != nil:
+		if opts.Hasher.ID() != h.hasher || opts.Hasher.Seed() != h.seed {
+			return nil, errs.New("file hasher id:%d seed:%d does not match options id:%d seed:%d",
+				h.hasher, h.seed, opts.Hasher.ID(), opts.Hasher.Seed())
+		}
+		c.hasher = opts.Hasher
+	case h.hasher == wyHasherID:
+		c.hasher = NewHasher(h.seed)
+	default:
+		return nil, errs.New("file hasher id:%d must be passed in options", h.hasher)
 	}
+
+	for i, lh := range h.levels {
+		size := levelSize(lh.layout, lh.q, lh.r, slotBits(lh.v, lh.counting))
+		if lh.offset+size > stSize {
+			return nil, errs.New("file too small to contain level %d", i)
+		}
+
+		buf, err := c.mmap(lh.offset, size)
+		if err != nil {
+			return nil, errs.Wrap(err)
+		}
+		if lh.offset+size > c.size {
+			c.size = lh.offset + size
+		}
+
+		l := level{
+			filter: newFilter(lh.layout, lh.counting, lh.q, lh.r, lh.v, buf),
+			off:    lh.offset,
+			live:   lh.live,
+		}
+		l.setLen(lh.len)
+
+		switch {
+		case lh.live:
+			l.setLen(l.count())
+
+		case lh.dirty:
+			// the level may hold the output of an interrupted spill. the
+			// other empty levels are not read, which would fault their
+			// discarded pages back in.
+			if err := c.clear(l); err != nil {
+				return nil, errs.Wrap(err)
+			}
+		}
+
+		if lh.spare {
+			if l.Empty() {
+				l.live = false
+				c.spare = l
+			} else {
+				c.frozen = l
+			}
+			continue
+		}
+
+		if len(c.levels) == 0 {
+			c.layout, c.counting, c.vbits = lh.layout, lh.counting, lh.v
+		}
+		c.levels = append(c.levels, l)
+		c.q, c.r = lh.q, lh.r
+	}
+
+	if len(c.levels) == 0 {
+		return nil, errs.New("header has no levels")
+	}
+
+	// the summaries are only kept in memory, and reading every level to
+	// rebuild them would make opening slow, so they are built in the
+	// background. the levels are probed until then.
+	for i := 1; i < len(c.levels); i++ {
+		if l := c.levels[i]; !l.Empty() {
+			c.levels[i].sum = newSummary(uint64(l.Len()), l.Bits(), c.summaryBits(l))
+		}
+	}
+
+	c.gen = h.generation
+
+	// remove the level files left behind by a spill that was interrupted
+	// before or after committing the manifest.
+	if c.ms != nil {
+		live := make(map[int64]bool)
+		for _, lh := range h.levels {
+			live[lh.offset] = true
+		}
+		if err := c.ms.prune(live); err != nil {
+			return nil, errs.Wrap(err)
+		}
+	}
+
+	// we crashed after clearing level 0 but before marking it live again.
+	if !c.levels[0].live {
+		c.levels[0].live = true
+		if err := c.commit(); err != nil {
+			return nil, errs.Wrap(err)
+		}
+	}
+
+	// we crashed during a background spill, so finish it. if there is no
+	// room, the frozen level stays around until there is.
+	if c.frozen.filter != nil {
+		if err := c.spill(); err != nil && errs.Unwrap(err) != ErrFull {
+			return nil, errs.Wrap(err)
+		}
+	}
+
+	c.advise()
+
+	c.summarizing = make(chan struct{})
+	go c.summarize()
+
+	return c, nil
+}
+
+// unmap releases all of the mappings and forgets about the levels.
+func (c *casFilter) unmap() (err error) {
+	err = c.st.Release()
+	c.mappings = nil
+	c.levels = nil
+	c.spare, c.frozen = level{}, level{}
+	c.unused = nil
+	c.hdr = nil
+	return errs.Wrap(err)
+}
+
+// Close waits for any background spill, syncs the filter to disk and releases
+// all of its mappings. The backing file or storage is not closed. Any further
+// operations return an error.
+func (c *casFilter) Close() (err error) {
+	defer mon.Start().Stop(&err)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closed {
+		return errs.New("filter already closed")
+	}
+
+	err = c.wait()
+	if serr := c.sync(); err == nil {
+		err = serr
+	}
+
+	c.mu.Lock()
+	if uerr := c.unmap(); err == nil {
+		err = uerr
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	return errs.Wrap(err)
+}
+
+func (c *casFilter) QuotientBits() uint {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.q
+}
+
+func (c *casFilter) RemainderBits() uint {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.r
 }
 
-func (c *casFilter) QuotientBits() uint  { return c.q }
-func (c *casFilter) RemainderBits() uint { return c.r }
+// ValueBits returns the number of bits of the value stored with every hash.
+func (c *casFilter) ValueBits() uint { return c.vbits }
+
+// hashBits returns the number of bits of a hash that the levels keep.
+func (c *casFilter) hashBits() uint {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.q + c.r
+}
+
+// iters returns iterators over every level from newest to oldest. It must be
+// called with mu held.
+func (c *casFilter) iters() []iterator {
+	its := make([]iterator, 0, len(c.levels)+1)
+	for i, l := range c.levels {
+		its = append(its, l.Iter())
+
+		// a frozen level was level 0 before the current one, so it is newer
+		// than the rest.
+		if i == 0 && c.frozen.filter != nil {
+			its = append(its, c.frozen.Iter())
+		}
+	}
+	return its
+}
 
 func (c *casFilter) Len() uint {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
 	o := uint(0)
-	for _, qf := range c.levels {
-		o += qf.Len()
+	for _, l := range c.levels {
+		o += l.Len()
+	}
+	if c.frozen.filter != nil {
+		o += c.frozen.Len()
 	}
 	return o
 }
 
-// newLevel truncates the backing file to be large enough to hold a new level
-// and maps the new section into a buffer.
+// MaxLevels returns the number of levels the filter can have before Add
+// returns ErrFull.
+func (c *casFilter) MaxLevels() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	r := c.r
+	if len(c.levels) > 0 {
+		r = c.levels[0].RemainderBits()
+	}
+	if min := c.opts.minRemainder(); r >= min {
+		return 2 + int((r-min)/c.opts.growthBits())
+	}
+	return 0
+}
+
+// EstimatedFPR returns the expected false positive rate of a lookup. Each
+// level with a fraction a of its slots full has a false positive rate of
+// about a*2^-r, and a lookup is a false positive if any level is.
+func (c *casFilter) EstimatedFPR() float64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	miss := 1.0
+	add := func(l level) {
+		miss *= 1 - math.Ldexp(float64(l.Len()), -int(l.Bits()))
+	}
+
+	for _, l := range c.levels {
+		add(l)
+	}
+	if c.frozen.filter != nil {
+		add(c.frozen)
+	}
+	return 1 - miss
+}
+
+// Usage is the space used by a filter.
+type Usage struct {
+	Size      int64 // bytes of the storage, including discarded levels
+	Allocated int64 // bytes of disk or memory used by the storage
+	Resident  int64 // bytes of the mapped levels that are in memory
+	Summary   int64 // bytes of the level summaries kept in memory
+}
+
+// Usage returns the space used by the filter. Levels emptied by a spill are
+// discarded, so they count toward the size but not the rest.
+func (c *casFilter) Usage() (u Usage, err error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.closed {
+		return u, errs.New("filter closed")
+	}
+
+	if u.Size, err = c.st.Size(); err != nil {
+		return u, errs.Wrap(err)
+	}
+	if u.Allocated, err = c.st.Allocated(); err != nil {
+		return u, errs.Wrap(err)
+	}
+	for _, m := range c.mappings {
+		n, err := resident(m)
+		if err != nil {
+			return u, errs.Wrap(err)
+		}
+		u.Resident += n
+	}
+	for _, l := range c.levels {
+		u.Summary += l.sum.bytes()
+	}
+	return u, nil
+}
+
+// pageSize returns the size that every mapping is rounded up to.
+func pageSize() int64 { return int64(unix.Getpagesize()) }
+
+// levelSize returns the size of the mapping for a level with the given
+// layout and quotient and remainder bits, and v bits from slotBits.
+func levelSize(l Layout, q, r, v uint) int64 {
+	return (int64(l.size(q, r, v)) + pageSize() - 1) / pageSize() * pageSize()
+}
+
+// mmap maps size bytes of the storage starting at off and keeps track of the
+// mapping.
+func (c *casFilter) mmap(off, size int64) ([]byte, error) {
+	buf, err := c.st.Map(off, size)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+
+	c.mu.Lock()
+	c.mappings = append(c.mappings, buf)
+	c.mu.Unlock()
+
+	return buf, nil
+}
+
+// msync flushes the mapped buffer to the storage.
+func (c *casFilter) msync(buf []byte) error {
+	return errs.Wrap(c.st.Sync(buf))
+}
+
+// summarize builds the summaries of the levels that the filter was opened
+// with. It stops early if the filter is closed, and skips a level if a spill
+// replaces it first.
+func (c *casFilter) summarize() {
+	defer close(c.summarizing)
+
+	for i := 1; ; i++ {
+		c.mu.RLock()
+		if c.closed || i >= len(c.levels) {
+			c.mu.RUnlock()
+			return
+		}
+		l := c.levels[i]
+		c.mu.RUnlock()
+
+		if l.sum != nil && !l.sum.ready() && !c.summarizeLevel(i, l) {
+			return
+		}
+	}
+}
+
+// summaryBits returns the bits per hash of the summary for the level, which
+// scale up from the configured bits of the deepest level.
+func (c *casFilter) summaryBits(l level) int {
+	deepest := c.levels[len(c.levels)-1].QuotientBits()
+	if q := l.QuotientBits(); q < deepest {
+		return scaleSummaryBits(c.opts.summaryBits(), deepest-q)
+	}
+	return c.opts.summaryBits()
+}
+
+// summaryChunk is the number of fingerprints added to a summary for every
+// time the read lock is taken.
+const summaryChunk = 4096
+
+// summarizeLevel adds the fingerprints of the ith level, which must be l, to
+// its summary and marks it ready. It only holds the read lock while reading
+// a chunk of the fingerprints, so writers are not blocked for long. It stops
+// if the level is replaced, and reports false if the filter is closed.
+func (c *casFilter) summarizeLevel(i int, l level) bool {
+	// the iterator is read until it is exhausted rather than up to the
+	// largest hash, which does not fit when the level has 64 bits.
+	from, more := uint64(0), true
+	for more {
+		c.mu.RLock()
+		if c.closed {
+			c.mu.RUnlock()
+			return false
+		}
+		if i >= len(c.levels) || c.levels[i].filter != l.filter {
+			c.mu.RUnlock()
+			return true
+		}
+
+		it := l.Iter()
+		it.Seek(from)
+		for n := 0; more && n < summaryChunk; n++ {
+			if more = it.Next(); more {
+				l.sum.add(it.Hash())
+				from, more = it.Hash()+1, it.Hash() != math.MaxUint64
+			}
+		}
+		c.mu.RUnlock()
+	}
+
+	l.sum.finish()
+	return true
+}
+
+// clear empties the level by discarding its buffer, so that its pages take
+// no space until they are written again.
+func (c *casFilter) clear(l level) error {
+	l.setLen(0)
+
+	// locked pages cannot be discarded, so they are locked again by the
+	// next hints.
+	if c.opts.LockHot {
+		if err := unix.Munlock(l.buffer()); err != nil {
+			return errs.Wrap(err)
+		}
+	}
+	return errs.Wrap(c.st.Discard(l.off, l.buffer()))
+}
+
+// commit records the current set of levels into the older header slot and
+// syncs it, making it the current header.
+func (c *casFilter) commit() error {
+	c.gen++
+
+	h := header{
+		version:    headerVersion,
+		pageSize:   pageSize(),
+		bits:       c.q + c.r,
+		generation: c.gen,
+		hasher:     c.hasher.ID(),
+		seed:       c.hasher.Seed(),
+	}
+
+	add := func(l level, spare bool) {
+		h.levels = append(h.levels, levelHeader{
+			q:        l.QuotientBits(),
+			r:        l.RemainderBits(),
+			v:        c.vbits,
+			live:     l.live,
+			spare:    spare,
+			counting: c.counting,
+			dirty:    l.dirty,
+			layout:   c.layout,
+			len:      l.Len(),
+			offset:   l.off,
+		})
+	}
+
+	// level 0 may be receiving adds during a background spill.
+	c.mu.RLock()
+	for _, l := range c.levels {
+		add(l, false)
+	}
+	if c.frozen.filter != nil {
+		add(c.frozen, true)
+	}
+	if c.spare.filter != nil {
+		add(c.spare, true)
+	}
+	c.mu.RUnlock()
+
+	if c.ms != nil {
+		buf := make([]byte, h.size())
+		h.marshal(buf)
+		return errs.Wrap(c.ms.writeManifest(buf))
+	}
+
+	h.marshal(headerSlot(c.hdr, c.gen))
+	return c.msync(c.hdr)
+}
+
+// crashPoint calls the step hook if one is set.
+func (c *casFilter) crashPoint() error {
+	if c.step == nil {
+		return nil
+	}
+	return c.step()
+}
+
+// alloc returns an empty level with the given geometry. It reuses a
+// discarded buffer of the same size if there is one, and otherwise grows the
+// storage to hold the level and maps the new section into a buffer.
+func (c *casFilter) alloc(q, r uint) (level, error) {
+	size := levelSize(c.layout, q, r, slotBits(c.vbits, c.counting))
+
+	// a discarded buffer of the same size reads as zero, so it is reused.
+	for i, u := range c.unused {
+		if int64(len(u.buffer())) == size {
+			c.unused = append(c.unused[:i], c.unused[i+1:]...)
+			return level{
+				filter: newFilter(c.layout, c.counting, q, r, c.vbits, u.buffer()),
+				off:    u.off,
+			}, nil
+		}
+	}
+
+	// anything past the levels was allocated by an interrupted spill, so it
+	// is dropped first to have the new level read as zero.
+	stSize, err := c.st.Size()
+	if err != nil {
+		return level{}, errs.Wrap(err)
+	}
+	if stSize > c.size {
+		if err := c.st.Allocate(c.size); err != nil {
+			return level{}, errs.Wrap(err)
+		}
+	}
+
+	if err := c.st.Allocate(c.size + size); err != nil {
+		return level{}, errs.Wrap(err)
+	}
+
+	buf, err := c.mmap(c.size, size)
+	if err != nil {
+		return level{}, errs.Wrap(err)
+	}
+
+	l := level{
+		filter: newFilter(c.layout, c.counting, q, r, c.vbits, buf),
+		off:    c.size,
+	}
+	c.size += size
+
+	return l, nil
+}
+
+// newLevel allocates a new level at the end of the cascade. It returns
+// ErrFull without changing anything if the level would have too few
+// remainder bits.
 func (c *casFilter) newLevel() (err error) {
 	defer mon.Start().Stop(&err)
 
 	// level 0 and level 1 are the same size
+	step := uint(0)
 	if len(c.levels) > 1 {
-		c.q++
-		c.r--
+		step = c.opts.growthBits()
 	}
-
-	// round the size up to the next page
-	pageSize := int64(unix.Getpagesize())
-	size := (int64(bufSize(c.q, c.r)) + pageSize - 1) / pageSize * pageSize
-
-	currentSize := int64(0)
-	for _, qf := range c.levels {
-		currentSize += int64(len(qf.br.buf))
+	if c.r < step+c.opts.minRemainder() {
+		return errs.Wrap(ErrFull)
 	}
+	q, r := c.q+step, c.r-step
 
-	if err := c.fh.Truncate(currentSize + int64(size)); err != nil {
-		return errs.Wrap(err)
+	// the header lives in the first page and is mapped with the first level.
+	// a manifest takes its place, but the page is still reserved.
+	if c.size == 0 {
+		if c.ms == nil {
+			if err := c.st.Allocate(pageSize()); err != nil {
+				return errs.Wrap(err)
+			}
+			c.hdr, err = c.mmap(0, pageSize())
+			if err != nil {
+				return errs.Wrap(err)
+			}
+		}
+		c.size = pageSize()
 	}
 
-	buf, err := unix.Mmap(int(c.fh.Fd()), currentSize, int(size),
-		unix.PROT_WRITE|unix.PROT_READ, unix.MAP_SHARED)
+	l, err := c.alloc(q, r)
 	if err != nil {
 		return errs.Wrap(err)
 	}
+	l.live = len(c.levels) == 0
 
-	c.mappings = append(c.mappings, buf)
+	c.mu.Lock()
+	c.levels = append(c.levels, l)
+	c.q, c.r = q, r
+	c.changes++
+	c.mu.Unlock()
 
-	qf := newQuoFil(c.q, c.r, buf)
-	qf.Clear()
+	c.advise()
+	return c.commit()
+}
+
+// fail marks the filter as broken.
+func (c *casFilter) fail(err error) {
+	c.mu.Lock()
+	c.broken = err
+	c.mu.Unlock()
+}
 
-	c.levels = append(c.levels, qf)
+// failed returns the error that broke the filter, if any.
+func (c *casFilter) failed() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 
-	return nil
+	return c.broken
 }
 
-// spill takes the non-empty prefix of the levels and inserts them into
-// the first empty level, allocating one if necessary.
+// spill merges the prefix of the levels into the first level past level 0
+// that can hold the prefix along with what it already has without going over
+// the load factor, allocating a new level if none can. Every level is a
+// growth factor larger than the one before it, so it takes about that many
+// spills before it is merged into the next. If there is a frozen level 0, it
+// starts the prefix in place of level 0, which is left alone.
+//
+// the destination is written and synced while the header still describes
+// its old contents, either in place when it is empty or into another buffer
+// when it is not, and a single header commit moves the elements from the
+// prefix into it. only then are the prefix and the old buffer cleared. a crash
+// at any point leaves the file describing either the state before the spill
+// or the state after.
 func (c *casFilter) spill() (err error) {
 	defer mon.Start().Stop(&err)
 
-	var prefix []*quoFil
-	for i, qf := range c.levels {
-		if qf.Empty() {
+	var prefix []level
+	first, n := 0, uint(0)
+	if c.frozen.filter != nil {
+		prefix, first, n = append(prefix, c.frozen), 1, c.frozen.Len()
+	}
+
+	dst := first
+	for ; dst < len(c.levels); dst++ {
+		l := c.levels[dst]
+		if dst > 0 && (l.Empty() ||
+			float64(n+l.Len()) <= c.opts.loadFactor()*float64(l.Cap())) {
 			break
 		}
-		prefix = c.levels[:i+1]
+		prefix = append(prefix, l)
+		n += l.Len()
 	}
 
-	if len(prefix) == len(c.levels) {
+	if dst == len(c.levels) {
 		if err := c.newLevel(); err != nil {
 			return errs.Wrap(err)
 		}
 	}
 
-	// TODO(jeff): merge could be faster here by using the fact that
-	// iterators return in sorted order. it would be contiguous writes.
-	out := c.levels[len(prefix)]
-	for _, qf := range prefix {
-		for it := qf.Iter(); it.Next(); {
-			out.Add(it.Hash())
+	// the spill replaces or empties levels, so their hints may change.
+	defer c.advise()
+
+	// any error after this point leaves the levels in an inconsistent state
+	// in memory, so the filter has to be reopened.
+	defer func() {
+		if err != nil {
+			c.fail(err)
 		}
-		qf.Clear()
+	}()
+
+	if err := c.crashPoint(); err != nil {
+		return errs.Wrap(err)
+	}
+
+	if c.ms != nil {
+		return c.spillManifest(prefix, first, dst)
 	}
 
-	if err := c.sync(); err != nil {
+	// the iterators return in sorted order, so the destination can be
+	// built with contiguous writes. it is built into a separate filter so
+	// that lookups continue to see the destination as it was. the prefix is
+	// ordered from newest to oldest and the destination is older than all
+	// of it, so the merge keeps the newest values.
+	its := make([]iterator, 0, len(prefix)+1)
+	for _, l := range prefix {
+		its = append(its, l.Iter())
+	}
+
+	out, old := c.levels[dst], level{}
+	if out.Empty() {
+		out.filter = newFilter(c.layout, c.counting,
+			out.QuotientBits(), out.RemainderBits(), c.vbits, out.buffer())
+
+		// the destination is marked dirty before it is written so that it
+		// is cleared on open if we crash before publishing it.
+		c.mu.Lock()
+		c.levels[dst].dirty = true
+		c.mu.Unlock()
+
+		if err := c.commit(); err != nil {
+			return errs.Wrap(err)
+		}
+	} else {
+		its = append(its, out.Iter())
+		old = out
+		out, err = c.alloc(old.QuotientBits(), old.RemainderBits())
+		if err != nil {
+			return errs.Wrap(err)
+		}
+	}
+	out.sum = newSummary(uint64(n+c.levels[dst].Len()), out.Bits(), c.summaryBits(out))
+	b := out.builder()
+	for it := newMergeIter(its, c.counting); it.Next(); {
+		if !b.Add(it.Hash(), it.Value(), it.Count()) {
+			return errs.New("level %d has no room for the spill", dst)
+		}
+		out.sum.add(it.Hash())
+	}
+	out.sum.finish()
+	if err := c.crashPoint(); err != nil {
+		return errs.Wrap(err)
+	}
+
+	if err := c.msync(out.buffer()); err != nil {
+		return errs.Wrap(err)
+	}
+	if err := c.crashPoint(); err != nil {
+		return errs.Wrap(err)
+	}
+
+	// publish the merged level and replace the prefix with empty levels.
+	// taking the lock waits for any lookups still using the old levels, so
+	// it is then safe to clear them. the emptied levels are dirty in the
+	// header so that if we crash before they are cleared, they are cleared
+	// on open.
+	empty := func(l level) level {
+		l.filter = newFilter(c.layout, c.counting,
+			l.QuotientBits(), l.RemainderBits(), c.vbits, l.buffer())
+		l.live, l.dirty, l.sum = false, true, nil
+		return l
+	}
+
+	c.mu.Lock()
+	c.levels[dst] = out
+	c.changes++
+	for i := first; i < dst; i++ {
+		c.levels[i] = empty(c.levels[i])
+	}
+	if first == 1 {
+		c.spare, c.frozen = empty(c.frozen), level{}
+	}
+	c.mu.Unlock()
+
+	if err := c.commit(); err != nil {
+		return errs.Wrap(err)
+	}
+	if err := c.crashPoint(); err != nil {
 		return errs.Wrap(err)
 	}
 
+	for _, l := range prefix {
+		if err := c.clear(l); err != nil {
+			return errs.Wrap(err)
+		}
+		if err := c.crashPoint(); err != nil {
+			return errs.Wrap(err)
+		}
+	}
+
+	// the old buffer of the destination is no longer in the header, so it
+	// can be reused by the next level of the same size.
+	if old.filter != nil {
+		if err := c.clear(old); err != nil {
+			return errs.Wrap(err)
+		}
+		c.unused = append(c.unused, old)
+	}
+
+	c.mu.Lock()
+	for i := first; i < dst; i++ {
+		c.levels[i].dirty = false
+	}
+	c.spare.dirty = false
+	if first == 0 {
+		c.levels[0].live = true
+	}
+	c.mu.Unlock()
+
+	return c.commit()
+}
+
+// spillManifest is spill for storage with a manifest. the destination is
+// built into a new level and the prefix is replaced by new empty levels, so
+// committing the manifest is the only step that changes the filter. the old
+// levels are freed afterward, and a crash before then leaves them to be
+// removed on open.
+func (c *casFilter) spillManifest(prefix []level, first, dst int) (err error) {
+	out, err := c.alloc(c.levels[dst].QuotientBits(), c.levels[dst].RemainderBits())
+	if err != nil {
+		return errs.Wrap(err)
+	}
+
+	its, n := make([]iterator, 0, len(prefix)+1), c.levels[dst].Len()
+	for _, l := range prefix {
+		its, n = append(its, l.Iter()), n+l.Len()
+	}
+	if !c.levels[dst].Empty() {
+		its = append(its, c.levels[dst].Iter())
+	}
+	out.sum = newSummary(uint64(n), out.Bits(), c.summaryBits(out))
+
+	b := out.builder()
+	for it := newMergeIter(its, c.counting); it.Next(); {
+		if !b.Add(it.Hash(), it.Value(), it.Count()) {
+			return errs.New("level %d has no room for the spill", dst)
+		}
+		out.sum.add(it.Hash())
+	}
+	out.sum.finish()
+	if err := c.crashPoint(); err != nil {
+		return errs.Wrap(err)
+	}
+
+	if err := c.msync(out.buffer()); err != nil {
+		return errs.Wrap(err)
+	}
+	if err := c.crashPoint(); err != nil {
+		return errs.Wrap(err)
+	}
+
+	// level 0 is empty as soon as it is replaced, so it stays live.
+	empties := make([]level, 0, dst-first)
+	for i := first; i < dst; i++ {
+		l, err := c.alloc(c.levels[i].QuotientBits(), c.levels[i].RemainderBits())
+		if err != nil {
+			return errs.Wrap(err)
+		}
+		l.live = i == 0
+		empties = append(empties, l)
+	}
+
+	// taking the lock waits for any lookups still using the old levels, so
+	// it is then safe to free them.
+	old := append(prefix, c.levels[dst])
+
+	c.mu.Lock()
+	c.levels[dst] = out
+	copy(c.levels[first:dst], empties)
+	c.frozen = level{}
+	c.changes++
+	c.mu.Unlock()
+
+	if err := c.commit(); err != nil {
+		return errs.Wrap(err)
+	}
+	if err := c.crashPoint(); err != nil {
+		return errs.Wrap(err)
+	}
+
+	for _, l := range old {
+		if err := c.free(l); err != nil {
+			return errs.Wrap(err)
+		}
+	}
 	return nil
 }
 
-func (c *casFilter) sync() (err error) {
+// free forgets about the mapping of the level and frees it from the storage,
+// which must have a manifest.
+func (c *casFilter) free(l level) error {
+	buf := l.buffer()
+	c.mu.Lock()
+	for i, m := range c.mappings {
+		if len(m) > 0 && &m[0] == &buf[0] {
+			c.mappings = append(c.mappings[:i], c.mappings[i+1:]...)
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	return errs.Wrap(c.ms.free(l.off))
+}
+
+// spillBackground freezes level 0, replacing it with the spare buffer, and
+// starts spilling the frozen level in the background. It waits for any
+// previous background spill to finish first, and retries it if it was unable
+// to make room.
+func (c *casFilter) spillBackground() (err error) {
+	if err := c.wait(); err != nil {
+		return errs.Wrap(err)
+	}
+	if c.frozen.filter != nil {
+		if err := c.spill(); err != nil {
+			return errs.Wrap(err)
+		}
+	}
+
+	if c.spare.filter == nil {
+		c.spare, err = c.alloc(c.levels[0].QuotientBits(), c.levels[0].RemainderBits())
+		if err != nil {
+			return errs.Wrap(err)
+		}
+	}
+
+	c.mu.Lock()
+	c.frozen, c.levels[0] = c.levels[0], c.spare
+	c.levels[0].live = true
+	c.spare = level{}
+	c.changes++
+	c.mu.Unlock()
+	c.advise()
+
+	// without a spill running, the frozen level would be lost by the next
+	// swap, so failing to commit breaks the filter.
+	if err := c.commit(); err != nil {
+		c.fail(err)
+		return errs.Wrap(err)
+	}
+
+	s := &bgSpill{done: make(chan struct{})}
+	c.spilling = s
+	go func() {
+		defer close(s.done)
+		s.err = c.spill()
+	}()
+
 	return nil
+}
+
+// wait waits for any background spill to finish and returns any error that
+// left the filter broken. A spill that failed without breaking the filter
+// leaves the frozen level in place. It must be called with wmu held.
+func (c *casFilter) wait() error {
+	if c.spilling != nil {
+		<-c.spilling.done
+		c.spilling = nil
+	}
+	return c.failed()
+}
+
+// Flush waits for any background spill to finish, returning its error.
+func (c *casFilter) Flush(ctx context.Context) (err error) {
+	defer mon.Start().Stop(&err)
 
-	// defer mon.Start().Stop(&err)
+	c.wmu.Lock()
+	s := c.spilling
+	c.wmu.Unlock()
 
-	// // really tank performance. the goal is to simulate a situation
-	// // were we don't have any memory available.
-	// for _, m := range c.mappings {
-	// 	if err := unix.Msync(m, unix.MS_SYNC); err != nil {
-	// 		return err
-	// 	}
-	// 	if err := unix.Madvise(m, unix.MADV_DONTNEED); err != nil {
-	// 		return err
-	// 	}
-	// }
+	if s != nil {
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			return errs.Wrap(ctx.Err())
+		}
+		if s.err != nil {
+			return errs.Wrap(s.err)
+		}
+	}
 
-	// // REALLY tank performance. drop all the caches.
-	// return exec.Command("sudo", "bash", "-c", "echo 3 > /proc/sys/vm/drop_caches").Run()
+	return errs.Wrap(c.failed())
 }
 
-var addThunk mon.Thunk
+// Sync flushes every level and the header to disk, waiting for any background
+// spill to finish first. Elements added since the last spill are only durable
+// after a call to Sync.
+func (c *casFilter) Sync() (err error) {
+	defer mon.Start().Stop(&err)
 
-func (c *casFilter) Add(hash uint64) (err error) {
-	if len(c.levels) == 0 {
-		if err := c.newLevel(); err != nil {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closed {
+		return errs.New("filter closed")
+	}
+	if err := c.wait(); err != nil {
+		return errs.Wrap(err)
+	}
+
+	return c.sync()
+}
+
+func (c *casFilter) sync() (err error) {
+	for _, m := range c.mappings {
+		if err := c.msync(m); err != nil {
 			return errs.Wrap(err)
 		}
 	}
+	return nil
+}
+
+var addThunk mon.Thunk
+
+func (c *casFilter) Add(hash uint64) error { return c.AddValue(hash, 0) }
+
+// AddValue adds the hash with the value, which must fit in the value bits.
+// If the hash is already in level 0, its value is replaced. Copies of the hash
+// in deeper levels keep their values until they are merged with the newer
+// copy, which replaces them.
+func (c *casFilter) AddValue(hash, value uint64) error { return c.addCount(hash, value, 1) }
+
+// addCount is like AddValue but adds the hash n times if the filter is
+// counting.
+func (c *casFilter) addCount(hash, value, n uint64) (err error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closed {
+		return errs.New("filter closed")
+	}
+	if err := c.failed(); err != nil {
+		return errs.Wrap(err)
+	}
+	if value>>c.vbits != 0 {
+		return errs.New("value %d does not fit in %d bits", value, c.vbits)
+	}
 
 	timer := addThunk.Start()
-	c.levels[0].Add(hash)
-	if c.levels[0].Len()*4 >= c.levels[0].Cap()*3 {
-		err = c.spill()
+	defer timer.Stop(&err)
+
+	c.mu.RLock()
+	qf := c.levels[0].filter
+	c.mu.RUnlock()
+
+	// make room before inserting so that if the spill is unable to, level 0
+	// is not filled past the threshold.
+	if float64(qf.Len()) >= c.opts.loadFactor()*float64(qf.Cap()) {
+		if c.opts.Background {
+			err = c.spillBackground()
+		} else {
+			err = c.spill()
+		}
+		if err != nil {
+			return errs.Wrap(err)
+		}
 	}
-	timer.Stop(&err)
-	return errs.Wrap(err)
+
+	c.mu.Lock()
+	ok := c.levels[0].AddCount(hash, value, n)
+	c.changes++
+	c.mu.Unlock()
+
+	// a level is left unchanged when it has no room, so the filter is still
+	// usable.
+	if !ok {
+		return errs.New("level 0 has no room for the hash")
+	}
+	return nil
 }
 
-func (c *casFilter) Lookup(hash uint64) bool {
-	for _, qf := range c.levels {
-		if !qf.Empty() && qf.Lookup(hash) {
-			return true
+// Remove removes the hash from every level that contains it, reporting if
+// any level did. If the filter is counting, it instead removes one of the
+// times it was added. Levels other than level 0 are not live, so each one is
+// marked live in the header before the hash is removed from it, and the
+// header is committed with its new length afterward.
+func (c *casFilter) Remove(hash uint64) (_ bool, err error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closed {
+		return false, errs.New("filter closed")
+	}
+	if err := c.wait(); err != nil {
+		return false, errs.Wrap(err)
+	}
+
+	found := false
+	c.mu.Lock()
+	// a frozen level is left behind by a background spill that was unable to
+	// make room. it is live, so the header does not need to change.
+	if c.frozen.filter != nil && c.frozen.Remove(hash) {
+		found = true
+	}
+	if len(c.levels) > 0 && !(found && c.counting) && c.levels[0].Remove(hash) {
+		found = true
+	}
+	c.changes++
+	c.mu.Unlock()
+
+	for i := 1; i < len(c.levels); i++ {
+		if found && c.counting {
+			break
+		}
+		l := c.levels[i]
+		if l.Empty() || !l.sum.has(hash) || !l.Lookup(hash) {
+			continue
+		}
+		if err := c.removeLevel(i, hash); err != nil {
+			return found, errs.Wrap(err)
+		}
+		found = true
+	}
+	return found, nil
+}
+
+// removeLevel removes the hash from a level past level 0. the level is live
+// while it is modified, so if we crash during the remove, its length is
+// recomputed on open.
+func (c *casFilter) removeLevel(i int, hash uint64) error {
+	c.mu.Lock()
+	c.levels[i].live = true
+	c.mu.Unlock()
+
+	if err := c.commit(); err != nil {
+		return errs.Wrap(err)
+	}
+	if err := c.crashPoint(); err != nil {
+		return errs.Wrap(err)
+	}
+
+	c.mu.Lock()
+	c.levels[i].Remove(hash)
+	c.levels[i].live = false
+	c.changes++
+	c.mu.Unlock()
+
+	if err := c.crashPoint(); err != nil {
+		return errs.Wrap(err)
+	}
+	return c.commit()
+}
+
+func (c *casFilter) Lookup(hash uint64) (bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.closed {
+		return false, errs.New("filter closed")
+	}
+
+	for _, l := range c.levels {
+		if !l.Empty() && l.sum.has(hash) && l.Lookup(hash) {
+			return true, nil
+		}
+	}
+	if c.frozen.filter != nil && c.frozen.Lookup(hash) {
+		return true, nil
+	}
+	return false, nil
+}
+
+// Get returns the value stored with the hash in the newest level that has
+// it. Since levels only store fingerprints, a hash that was never added may
+// be reported with the value of one that was.
+func (c *casFilter) Get(hash uint64) (uint64, bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.closed {
+		return 0, false, errs.New("filter closed")
+	}
+
+	for i, l := range c.levels {
+		if !l.Empty() && l.sum.has(hash) {
+			if v, ok := l.Get(hash); ok {
+				return v, true, nil
+			}
+		}
+
+		// a frozen level was level 0 before the current one, so it is newer
+		// than the rest.
+		if i == 0 && c.frozen.filter != nil {
+			if v, ok := c.frozen.Get(hash); ok {
+				return v, true, nil
+			}
+		}
+	}
+	return 0, false, nil
+}
+
+// Count returns the number of times the hash may have been added. If the
+// filter is not counting, it is at most one.
+func (c *casFilter) Count(hash uint64) (uint64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.closed {
+		return 0, errs.New("filter closed")
+	}
+
+	n := uint64(0)
+	for _, l := range c.levels {
+		if !l.Empty() && l.sum.has(hash) {
+			n += l.Count(hash)
 		}
 	}
-	return false
+	if c.frozen.filter != nil {
+		n += c.frozen.Count(hash)
+	}
+	if !c.counting && n > 1 {
+		n = 1
+	}
+	return n, nil
+}
+
+// AddKey adds the hash of the key.
+func (c *casFilter) AddKey(key []byte) error {
+	return c.Add(c.hasher.Hash(key))
+}
+
+// RemoveKey removes the hash of the key.
+func (c *casFilter) RemoveKey(key []byte) (bool, error) {
+	return c.Remove(c.hasher.Hash(key))
+}
+
+// LookupKey reports if the hash of the key may have been added.
+func (c *casFilter) LookupKey(key []byte) (bool, error) {
+	return c.Lookup(c.hasher.Hash(key))
 }
@@ -1,10 +1,18 @@
 package cascade
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/zeebo/assert"
+	"github.com/zeebo/errs"
 	"github.com/zeebo/pcg"
 )
 
@@ -20,4 +28,750 @@ func TestCascade(t *testing.T) {
 			cf.Add(pcg.Uint64())
 		}
 	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		fh, err := ioutil.TempFile("", "cascade")
+		assert.NoError(t, err)
+		defer os.Remove(fh.Name())
+		defer fh.Close()
+
+		cf := newCasFil(fh, 20)
+		var e []uint64
+		for i := 0; i < 10000; i++ {
+			x := pcg.Uint64()
+			e = append(e, x)
+			assert.NoError(t, cf.Add(x))
+		}
+
+		cf2, err := Open(fh)
+		assert.NoError(t, err)
+
+		assert.Equal(t, cf.Len(), cf2.Len())
+		assert.Equal(t, cf.QuotientBits(), cf2.QuotientBits())
+		assert.Equal(t, cf.RemainderBits(), cf2.RemainderBits())
+		for _, v := range e {
+			ok, err := cf2.Lookup(v)
+			assert.NoError(t, err)
+			assert.That(t, ok)
+		}
+	})
+
+	t.Run("Open Empty", func(t *testing.T) {
+		fh, err := ioutil.TempFile("", "cascade")
+		assert.NoError(t, err)
+		defer os.Remove(fh.Name())
+		defer fh.Close()
+
+		_, err = Open(fh)
+		assert.Error(t, err)
+	})
+
+	t.Run("Reopen Empty", func(t *testing.T) {
+		fh, err := ioutil.TempFile("", "cascade")
+		assert.NoError(t, err)
+		defer os.Remove(fh.Name())
+		defer fh.Close()
+
+		opts := Options{Layout: LayoutRankSelect, Counting: true, ValueBits: 8}
+		cf, err := NewOptions(fh, 20, opts)
+		assert.NoError(t, err)
+		assert.NoError(t, cf.Close())
+
+		// the settings are recorded before anything is added.
+		cf2, err := Open(fh)
+		assert.NoError(t, err)
+		assert.Equal(t, cf2.Len(), uint(0))
+		assert.Equal(t, cf2.QuotientBits(), cf.QuotientBits())
+		assert.Equal(t, cf2.RemainderBits(), cf.RemainderBits())
+		assert.Equal(t, cf2.layout, LayoutRankSelect)
+		assert.That(t, cf2.counting)
+		assert.Equal(t, cf2.ValueBits(), uint(8))
+		assert.NoError(t, cf2.Add(1))
+		assert.NoError(t, cf2.Close())
+	})
+
+	t.Run("Crash", func(t *testing.T) {
+		errCrash := errors.New("crash")
+
+		for _, opts := range []Options{
+			{},
+			{Background: true},
+			{Layout: LayoutRankSelect},
+			{Layout: LayoutRankSelect, Background: true},
+			{Growth: 4},
+			{Growth: 4, Background: true},
+		} {
+			for n := 1; ; n++ {
+				fh, err := ioutil.TempFile("", "cascade")
+				assert.NoError(t, err)
+				defer os.Remove(fh.Name())
+				defer fh.Close()
+
+				var e []uint64
+				cf, err := NewOptions(fh, 20, opts)
+				assert.NoError(t, err)
+				add := func() error {
+					x := pcg.Uint64()
+					if err := cf.Add(x); err != nil {
+						return err
+					}
+					e = append(e, x)
+					return cf.Flush(context.Background())
+				}
+
+				// fill up a couple of levels so that the spill has a prefix, and
+				// with a larger growth, a destination that is not empty.
+				for i := 0; i < 3000 || len(cf.levels) < 3 || cf.levels[1].Empty(); i++ {
+					assert.NoError(t, add())
+				}
+
+				steps := 0
+				cf.step = func() error {
+					steps++
+					if steps == n {
+						return errCrash
+					}
+					return nil
+				}
+
+				for steps == 0 {
+					if err := add(); err != nil {
+						assert.Equal(t, errs.Unwrap(err), errCrash)
+						break
+					}
+				}
+				_ = cf.unmap() // simulate the process dying
+
+				cf2, err := OpenOptions(fh, opts)
+				assert.NoError(t, err)
+
+				total := uint(0)
+				for _, l := range cf2.levels {
+					assert.Equal(t, l.Len(), l.count())
+					total += l.Len()
+				}
+				assert.Equal(t, cf2.Len(), total)
+
+				for _, v := range e {
+					ok, err := cf2.Lookup(v)
+					assert.NoError(t, err)
+					assert.That(t, ok)
+				}
+				for i := 0; i < 3000; i++ {
+					assert.NoError(t, cf2.Add(pcg.Uint64()))
+				}
+				assert.NoError(t, cf2.Close())
+
+				if steps < n {
+					break
+				}
+			}
+		}
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		fh, err := ioutil.TempFile("", "cascade")
+		assert.NoError(t, err)
+		defer os.Remove(fh.Name())
+		defer fh.Close()
+
+		cf := newCasFil(fh, 20)
+		assert.NoError(t, cf.Add(1))
+		assert.NoError(t, cf.Close())
+
+		assert.Error(t, cf.Add(2))
+		_, err = cf.Lookup(1)
+		assert.Error(t, err)
+		assert.Error(t, cf.Close())
+	})
+
+	t.Run("Close Leak", func(t *testing.T) {
+		countMaps := func() int {
+			data, err := ioutil.ReadFile("/proc/self/maps")
+			if err != nil {
+				t.Skip("unable to read /proc/self/maps:", err)
+			}
+			return bytes.Count(data, []byte("\n"))
+		}
+
+		residentPages := func() (pages int) {
+			data, err := ioutil.ReadFile("/proc/self/statm")
+			if err != nil {
+				t.Skip("unable to read /proc/self/statm:", err)
+			}
+			_, err = fmt.Sscan(string(data), new(int), &pages)
+			assert.NoError(t, err)
+			return pages
+		}
+
+		fh, err := ioutil.TempFile("", "cascade")
+		assert.NoError(t, err)
+		defer os.Remove(fh.Name())
+		defer fh.Close()
+
+		beforeMaps, beforeRSS := countMaps(), residentPages()
+		for i := 0; i < 2000; i++ {
+			assert.NoError(t, fh.Truncate(0))
+
+			cf := newCasFil(fh, 20)
+			for j := 0; j < 2000; j++ {
+				assert.NoError(t, cf.Add(pcg.Uint64()))
+			}
+			assert.NoError(t, cf.Close())
+		}
+		afterMaps, afterRSS := countMaps(), residentPages()
+
+		// leave some room for the runtime to grow the heap. leaking the
+		// mappings would be thousands of areas and tens of megabytes.
+		assert.That(t, afterMaps < beforeMaps+16)
+		assert.That(t, afterRSS < beforeRSS+1024)
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		fh, err := ioutil.TempFile("", "cascade")
+		assert.NoError(t, err)
+		defer os.Remove(fh.Name())
+		defer fh.Close()
+
+		// keep the hashes distinct in the low bits so there are no false
+		// positives to confuse removal.
+		cf := newCasFil(fh, 20)
+		e := make(map[uint64]bool)
+		for len(e) < 10000 {
+			x := pcg.Uint64() & (1<<20 - 1)
+			if !e[x] {
+				e[x] = true
+				assert.NoError(t, cf.Add(x))
+			}
+		}
+
+		removed := 0
+		for x := range e {
+			if removed >= 5000 {
+				break
+			}
+			ok, err := cf.Remove(x)
+			assert.NoError(t, err)
+			assert.That(t, ok)
+			delete(e, x)
+			removed++
+
+			ok, err = cf.Lookup(x)
+			assert.NoError(t, err)
+			assert.That(t, !ok)
+		}
+		assert.Equal(t, cf.Len(), uint(len(e)))
+
+		cf2, err := Open(fh)
+		assert.NoError(t, err)
+		assert.Equal(t, cf2.Len(), uint(len(e)))
+		for x := range e {
+			ok, err := cf2.Lookup(x)
+			assert.NoError(t, err)
+			assert.That(t, ok)
+		}
+	})
+
+	t.Run("Remove Crash", func(t *testing.T) {
+		errCrash := errors.New("crash")
+
+		for n := 1; ; n++ {
+			fh, err := ioutil.TempFile("", "cascade")
+			assert.NoError(t, err)
+			defer os.Remove(fh.Name())
+			defer fh.Close()
+
+			// the hashes are distinct so that removing one leaves the rest.
+			cf := newCasFil(fh, 20)
+			var e []uint64
+			seen := make(map[uint64]bool)
+			for len(cf.levels) < 3 || cf.levels[len(cf.levels)-1].Empty() {
+				x := pcg.Uint64() & (1<<20 - 1)
+				if !seen[x] {
+					seen[x] = true
+					e = append(e, x)
+					assert.NoError(t, cf.Add(x))
+				}
+			}
+
+			steps := 0
+			cf.step = func() error {
+				steps++
+				if steps == n {
+					return errCrash
+				}
+				return nil
+			}
+
+			// the first hash was spilled into a level past level 0.
+			ok, err := cf.Remove(e[0])
+			if err != nil {
+				assert.Equal(t, errs.Unwrap(err), errCrash)
+			} else {
+				assert.That(t, ok)
+			}
+			_ = cf.unmap() // simulate the process dying
+
+			cf2, err := Open(fh)
+			assert.NoError(t, err)
+			for _, l := range cf2.levels {
+				assert.Equal(t, l.Len(), l.count())
+			}
+			for _, x := range e[1:] {
+				ok, err := cf2.Lookup(x)
+				assert.NoError(t, err)
+				assert.That(t, ok)
+			}
+			assert.NoError(t, cf2.Close())
+
+			if steps < n {
+				break
+			}
+		}
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		for _, bg := range []bool{false, true} {
+			fh, err := ioutil.TempFile("", "cascade")
+			assert.NoError(t, err)
+			defer os.Remove(fh.Name())
+			defer fh.Close()
+
+			cf, err := NewOptions(fh, 20, Options{Background: bg})
+			assert.NoError(t, err)
+			defer cf.Close()
+
+			hashes := make([]uint64, 30000)
+			for i := range hashes {
+				hashes[i] = pcg.Uint64()
+			}
+
+			var added int64
+			var wg sync.WaitGroup
+			done := make(chan struct{})
+
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					var rng pcg.T
+					for {
+						select {
+						case <-done:
+							return
+						default:
+						}
+
+						n := atomic.LoadInt64(&added)
+						if n == 0 {
+							continue
+						}
+
+						x := hashes[rng.Uint32n(uint32(n))]
+						if ok, err := cf.Lookup(x); err != nil || !ok {
+							t.Errorf("lookup failed: %x %v %v", x, ok, err)
+							return
+						}
+						_ = cf.Len()
+					}
+				}()
+			}
+
+			for i, x := range hashes {
+				assert.NoError(t, cf.Add(x))
+				atomic.StoreInt64(&added, int64(i+1))
+			}
+
+			close(done)
+			wg.Wait()
+		}
+	})
+
+	t.Run("Background", func(t *testing.T) {
+		fh, err := ioutil.TempFile("", "cascade")
+		assert.NoError(t, err)
+		defer os.Remove(fh.Name())
+		defer fh.Close()
+
+		cf, err := NewOptions(fh, 20, Options{Background: true})
+		assert.NoError(t, err)
+		var e []uint64
+		for i := 0; i < 20000; i++ {
+			x := pcg.Uint64()
+			e = append(e, x)
+			assert.NoError(t, cf.Add(x))
+		}
+		assert.NoError(t, cf.Flush(context.Background()))
+		assert.NoError(t, cf.Close())
+
+		cf2, err := OpenOptions(fh, Options{Background: true})
+		assert.NoError(t, err)
+		defer cf2.Close()
+
+		for _, v := range e {
+			ok, err := cf2.Lookup(v)
+			assert.NoError(t, err)
+			assert.That(t, ok)
+		}
+	})
+
+	t.Run("Full", func(t *testing.T) {
+		for _, bg := range []bool{false, true} {
+			fill := func(min uint) int {
+				fh, err := ioutil.TempFile("", "cascade")
+				assert.NoError(t, err)
+				defer os.Remove(fh.Name())
+				defer fh.Close()
+
+				cf, err := NewOptions(fh, 18, Options{Background: bg, MinRemainder: min})
+				assert.NoError(t, err)
+				defer cf.Close()
+
+				var e []uint64
+				for {
+					x := pcg.Uint64()
+					if err := cf.Add(x); err != nil {
+						assert.Equal(t, errs.Unwrap(err), ErrFull)
+						break
+					}
+					e = append(e, x)
+				}
+				assert.That(t, cf.RemainderBits() >= min)
+
+				// the filter keeps refusing and answers lookups for everything
+				// that was added.
+				n := cf.Len()
+				err = cf.Add(pcg.Uint64())
+				assert.Equal(t, errs.Unwrap(err), ErrFull)
+				assert.Equal(t, cf.Len(), n)
+
+				for _, v := range e {
+					ok, err := cf.Lookup(v)
+					assert.NoError(t, err)
+					assert.That(t, ok)
+				}
+
+				return len(e)
+			}
+
+			assert.That(t, fill(3) > fill(5))
+		}
+	})
+
+	t.Run("Capacity", func(t *testing.T) {
+		fh, err := ioutil.TempFile("", "cascade")
+		assert.NoError(t, err)
+		defer os.Remove(fh.Name())
+		defer fh.Close()
+
+		const items, fpr = 100000, 0.01
+
+		cf, err := NewForCapacity(fh, items, fpr)
+		assert.NoError(t, err)
+		defer cf.Close()
+		assert.Equal(t, cf.EstimatedFPR(), 0.0)
+
+		for i := 0; i < items; i++ {
+			assert.NoError(t, cf.Add(pcg.Uint64()))
+		}
+		assert.That(t, len(cf.levels) <= cf.MaxLevels())
+
+		est := cf.EstimatedFPR()
+		assert.That(t, est > fpr/4 && est <= fpr)
+
+		count, total := 0, 100000
+		for i := 0; i < total; i++ {
+			ok, err := cf.Lookup(pcg.Uint64())
+			assert.NoError(t, err)
+			if ok {
+				count++
+			}
+		}
+		got := float64(count) / float64(total)
+		assert.That(t, got > est/2 && got < est*2)
+
+		_, err = NewForCapacity(fh, 0, fpr)
+		assert.Error(t, err)
+		_, err = NewForCapacity(fh, items, 0)
+		assert.Error(t, err)
+		_, err = NewForCapacity(fh, 1<<60, 1e-9)
+		assert.Error(t, err)
+	})
+
+	t.Run("Keys", func(t *testing.T) {
+		fh, err := ioutil.TempFile("", "cascade")
+		assert.NoError(t, err)
+		defer os.Remove(fh.Name())
+		defer fh.Close()
+
+		cf, err := NewOptions(fh, 20, Options{Hasher: NewHasher(42)})
+		assert.NoError(t, err)
+
+		var keys [][]byte
+		for i := 0; i < 5000; i++ {
+			key := []byte(fmt.Sprintf("key-%d", i))
+			keys = append(keys, key)
+			assert.NoError(t, cf.AddKey(key))
+		}
+		assert.NoError(t, cf.Close())
+
+		// the seed is recorded, so the default reopens with it.
+		cf2, err := Open(fh)
+		assert.NoError(t, err)
+		for _, key := range keys {
+			ok, err := cf2.LookupKey(key)
+			assert.NoError(t, err)
+			assert.That(t, ok)
+		}
+		ok, err := cf2.RemoveKey(keys[0])
+		assert.NoError(t, err)
+		assert.That(t, ok)
+		assert.NoError(t, cf2.Close())
+
+		_, err = OpenOptions(fh, Options{Hasher: NewHasher(43)})
+		assert.Error(t, err)
+	})
+
+	t.Run("Rank Select", func(t *testing.T) {
+		fh, err := ioutil.TempFile("", "cascade")
+		assert.NoError(t, err)
+		defer os.Remove(fh.Name())
+		defer fh.Close()
+
+		cf, err := NewOptions(fh, 20, Options{Layout: LayoutRankSelect})
+		assert.NoError(t, err)
+
+		var e []uint64
+		for i := 0; i < 20000; i++ {
+			x := pcg.Uint64()
+			e = append(e, x)
+			assert.NoError(t, cf.Add(x))
+		}
+		assert.That(t, len(cf.levels) > 2)
+		assert.NoError(t, cf.Close())
+
+		// the layout is recorded, so it is used without being specified.
+		cf2, err := Open(fh)
+		assert.NoError(t, err)
+		defer cf2.Close()
+
+		assert.Equal(t, cf2.layout, LayoutRankSelect)
+		for _, v := range e {
+			ok, err := cf2.Lookup(v)
+			assert.NoError(t, err)
+			assert.That(t, ok)
+		}
+		assert.NoError(t, cf2.Add(pcg.Uint64()))
+
+		// hashes with the same fingerprint are removed together.
+		removed := make(map[uint64]bool)
+		for _, v := range e[:1000] {
+			ok, err := cf2.Remove(v)
+			assert.NoError(t, err)
+			assert.Equal(t, ok, !removed[v&(1<<20-1)])
+			removed[v&(1<<20-1)] = true
+		}
+		for _, v := range e[1000:] {
+			ok, err := cf2.Lookup(v)
+			assert.NoError(t, err)
+			assert.Equal(t, ok, !removed[v&(1<<20-1)])
+		}
+	})
+
+	t.Run("Counting", func(t *testing.T) {
+		fh, err := ioutil.TempFile("", "cascade")
+		assert.NoError(t, err)
+		defer os.Remove(fh.Name())
+		defer fh.Close()
+
+		cf, err := NewOptions(fh, 20, Options{Counting: true})
+		assert.NoError(t, err)
+
+		// add hashes a few times each with enough others that the copies
+		// end up spread across levels.
+		counts := make(map[uint64]uint64)
+		for i := 0; i < 500; i++ {
+			x := pcg.Uint64()
+			for n := i%4 + 1; n > 0; n-- {
+				assert.NoError(t, cf.Add(x))
+				counts[x]++
+				for j := 0; j < 10; j++ {
+					assert.NoError(t, cf.Add(pcg.Uint64()))
+				}
+			}
+		}
+		assert.That(t, len(cf.levels) > 2)
+		assert.NoError(t, cf.Close())
+
+		// counting is recorded, so it is used without being specified.
+		cf2, err := Open(fh)
+		assert.NoError(t, err)
+		defer cf2.Close()
+
+		assert.That(t, cf2.counting)
+		for x, n := range counts {
+			got, err := cf2.Count(x)
+			assert.NoError(t, err)
+			assert.That(t, got >= n)
+
+			// removing takes away a single copy.
+			ok, err := cf2.Remove(x)
+			assert.NoError(t, err)
+			assert.That(t, ok)
+
+			got2, err := cf2.Count(x)
+			assert.NoError(t, err)
+			assert.Equal(t, got2, got-1)
+		}
+	})
+
+	t.Run("Counting Hot", func(t *testing.T) {
+		for _, layout := range []Layout{LayoutQuotient, LayoutRankSelect} {
+			fh, err := ioutil.TempFile("", "cascade")
+			assert.NoError(t, err)
+			defer os.Remove(fh.Name())
+			defer fh.Close()
+
+			cf, err := NewOptions(fh, 24, Options{Counting: true, Layout: layout})
+			assert.NoError(t, err)
+
+			// a hash added thousands of times among others is counted in a
+			// few slots in each level, so it never fills its cluster.
+			hot := pcg.Uint64()
+			var e []uint64
+			for i := 0; i < 5000; i++ {
+				assert.NoError(t, cf.Add(hot))
+				x := pcg.Uint64()
+				e = append(e, x)
+				assert.NoError(t, cf.Add(x))
+			}
+			assert.That(t, len(cf.levels) > 2)
+
+			got, err := cf.Count(hot)
+			assert.NoError(t, err)
+			assert.Equal(t, got, uint64(5000))
+			for _, x := range e {
+				ok, err := cf.Lookup(x)
+				assert.NoError(t, err)
+				assert.That(t, ok)
+			}
+
+			for i := 0; i < 5000; i++ {
+				ok, err := cf.Remove(hot)
+				assert.NoError(t, err)
+				assert.That(t, ok)
+			}
+			got, err = cf.Count(hot)
+			assert.NoError(t, err)
+			assert.Equal(t, got, uint64(0))
+			assert.NoError(t, cf.Close())
+		}
+	})
+
+	t.Run("Values", func(t *testing.T) {
+		for _, opts := range []Options{
+			{ValueBits: 16},
+			{ValueBits: 16, Layout: LayoutRankSelect, Background: true},
+		} {
+			fh, err := ioutil.TempFile("", "cascade")
+			assert.NoError(t, err)
+			defer os.Remove(fh.Name())
+			defer fh.Close()
+
+			cf, err := NewOptions(fh, 24, opts)
+			assert.NoError(t, err)
+
+			// distinct in the low 24 bits, so no two share a fingerprint.
+			hash := func(i uint64) uint64 { return i * 0x9e3779b1 & (1<<24 - 1) }
+
+			e := make(map[uint64]uint64)
+			for i := uint64(0); i < 20000; i++ {
+				assert.NoError(t, cf.AddValue(hash(i), i&0xffff))
+				e[hash(i)] = i & 0xffff
+			}
+
+			// replace the values of the oldest hashes, which are now in
+			// deeper levels.
+			for i := uint64(0); i < 1000; i++ {
+				assert.NoError(t, cf.AddValue(hash(i), 0xffff-i))
+				e[hash(i)] = 0xffff - i
+			}
+			assert.That(t, len(cf.levels) > 2)
+			assert.Error(t, cf.AddValue(hash(0), 1<<16))
+
+			check := func(cf *casFilter) {
+				for x, v := range e {
+					got, ok, err := cf.Get(x)
+					assert.NoError(t, err)
+					assert.That(t, ok)
+					assert.Equal(t, got, v)
+				}
+			}
+			check(cf)
+			assert.NoError(t, cf.Close())
+
+			// the value bits are recorded, so they are used without being
+			// specified.
+			cf2, err := Open(fh)
+			assert.NoError(t, err)
+			assert.Equal(t, cf2.ValueBits(), uint(16))
+			check(cf2)
+			assert.NoError(t, cf2.Close())
+		}
+	})
+
+	t.Run("Usage", func(t *testing.T) {
+		cf, done := tempFilter(t, 20, Options{})
+		defer done()
+
+		for len(cf.levels) < 4 || !cf.levels[1].Empty() {
+			assert.NoError(t, cf.Add(pcg.Uint64()))
+		}
+
+		// the emptied levels are discarded, so only the header and the
+		// levels holding something take up space, along with a block that
+		// the file system may use to keep track of the holes. without holes,
+		// they are only zeroed.
+		full := 2 * pageSize()
+		for _, l := range cf.levels {
+			if !l.Empty() {
+				full += levelSize(cf.layout, l.QuotientBits(), l.RemainderBits(), 0)
+			}
+		}
+
+		u, err := cf.Usage()
+		assert.NoError(t, err)
+		assert.Equal(t, u.Size, cf.size)
+		if punches(t) {
+			assert.That(t, u.Allocated <= full)
+			assert.That(t, u.Allocated < u.Size)
+		}
+		assert.That(t, u.Resident <= u.Size)
+
+		assert.NoError(t, cf.Close())
+		_, err = cf.Usage()
+		assert.Error(t, err)
+
+		// opening does not read the emptied levels back in. memory is used
+		// so that there is no readahead past the levels that are read.
+		st := NewMemStorage()
+		cf2, err := NewStorage(st, 20, Options{})
+		assert.NoError(t, err)
+		for len(cf2.levels) < 4 || !cf2.levels[1].Empty() {
+			assert.NoError(t, cf2.Add(pcg.Uint64()))
+		}
+		assert.NoError(t, cf2.Close())
+
+		cf3, err := OpenStorage(st, Options{})
+		assert.NoError(t, err)
+		for _, l := range cf3.levels[1:] {
+			if l.Empty() {
+				n, err := resident(l.buffer())
+				assert.NoError(t, err)
+				assert.Equal(t, n, int64(0))
+			}
+		}
+		assert.NoError(t, cf3.Close())
+	})
 }
@@ -22,6 +22,7 @@ var (
 	nodes           = flag.Int("nodes", 1, "number of nodes")
 	pointers        = flag.Int("pointers", 10000, "number of data pointers")
 	nodesPerPointer = flag.Int("nodes_per_pointer", 1, "number of nodes per pointer")
+	merge           = flag.Bool("merge", false, "merge the nodes into one filter and audit it")
 
 	rng pcg.T
 )
@@ -72,6 +73,7 @@ func run() error {
 		defer fh.Close()
 
 		fs[i] = cascade.New(fh, bits)
+		defer fs[i].Close()
 	}
 
 	var node0 []uint64
@@ -97,18 +99,52 @@ func run() error {
 		fs[0].RemainderBits(), fs[0].QuotientBits(), fs[0].Len())
 	fmt.Printf("NODE0: auditing %d values\n", len(node0))
 	for _, v := range node0 {
-		if !fs[0].Lookup(v) {
+		ok, err := fs[0].Lookup(v)
+		if err != nil {
+			return errs.Wrap(err)
+		}
+		if !ok {
 			return errs.New("false negative: 0x%08x\n", v&mask)
 		}
 	}
 
 	count, total := 0, 100*len(node0)
 	for i := 0; i < total; i++ {
-		if fs[0].Lookup(rng.Uint64()) {
+		ok, err := fs[0].Lookup(rng.Uint64())
+		if err != nil {
+			return errs.Wrap(err)
+		}
+		if ok {
 			count++
 		}
 	}
 	fmt.Printf("NODE0: got %d/%d == %0.4f%%\n", count, total, 100*float64(count)/float64(total))
+	fmt.Printf("NODE0: estimated %0.4f%%\n", 100*fs[0].EstimatedFPR())
+
+	if *merge {
+		fh, err := os.Create("data/merged")
+		if err != nil {
+			return errs.Wrap(err)
+		}
+		defer fh.Close()
+
+		all := cascade.New(fh, bits)
+		defer all.Close()
+
+		if err := cascade.Merge(all, fs...); err != nil {
+			return errs.Wrap(err)
+		}
+		fmt.Printf("MERGED: len: %d\n", all.Len())
+		for _, v := range node0 {
+			ok, err := all.Lookup(v)
+			if err != nil {
+				return errs.Wrap(err)
+			}
+			if !ok {
+				return errs.New("false negative after merge: 0x%08x\n", v&mask)
+			}
+		}
+	}
 
 	fmt.Println("done. waiting for ctrl+c...")
 	ch := make(chan os.Signal, 1)
@@ -0,0 +1,330 @@
+package cascade
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/zeebo/errs"
+	"golang.org/x/sys/unix"
+)
+
+//
+// a directory holds a filter as a manifest and one file per level. the
+// manifest is a header in the same format as a header slot, and it is
+// committed by writing it to a temporary file and renaming it over the old
+// one. each level file is named by the offset the level would have in a single
+// file, so the header does not need to change, and the first page is reserved
+// as if it held the header.
+//
+// a spill writes the merged level and the emptied levels to new files, so the
+// manifest rename is the only step that changes what the filter holds. the
+// files for the replaced levels are removed after it, and any level file that
+// the manifest does not mention is removed when the directory is opened.
+//
+
+const (
+	dirManifest = "manifest"
+	dirLevel    = "level-"
+)
+
+// manifestStorage is storage that keeps every region in its own file. The
+// header is kept in a manifest that is replaced atomically instead of in the
+// first page, and regions that are no longer used are freed.
+type manifestStorage interface {
+	Storage
+
+	// readManifest returns the header in the manifest.
+	readManifest() ([]byte, error)
+
+	// writeManifest atomically replaces the manifest with the header.
+	writeManifest(buf []byte) error
+
+	// free unmaps and removes the region starting at off.
+	free(off int64) error
+
+	// prune frees every region that does not start at a live offset.
+	prune(live map[int64]bool) error
+}
+
+// dirStorage keeps every region in its own file in a directory.
+type dirStorage struct {
+	dir string
+
+	mu       sync.Mutex
+	size     int64
+	regions  map[int64]int64    // size of the region at each offset
+	mappings map[int64][][]byte // mappings of the region at each offset
+}
+
+// newDirStorage returns the storage for the directory, finding the level
+// files already in it.
+func newDirStorage(dir string) (*dirStorage, error) {
+	d := &dirStorage{
+		dir:      dir,
+		size:     pageSize(),
+		regions:  make(map[int64]int64),
+		mappings: make(map[int64][][]byte),
+	}
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	for _, fi := range fis {
+		if !strings.HasPrefix(fi.Name(), dirLevel) {
+			continue
+		}
+		off, err := strconv.ParseInt(strings.TrimPrefix(fi.Name(), dirLevel), 16, 64)
+		if err != nil {
+			continue
+		}
+		d.regions[off] = fi.Size()
+		if end := off + fi.Size(); end > d.size {
+			d.size = end
+		}
+	}
+
+	return d, nil
+}
+
+// NewDir is like NewOptions but keeps the filter in the directory, which is
+// created if it does not exist, as a manifest and one file per level. Spills
+// write the merged level to a new file and commit by renaming the manifest,
+// and the files of the replaced levels are removed afterward.
+func NewDir(dir string, bits uint, opts Options) (*casFilter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errs.Wrap(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, dirManifest)); err == nil {
+		return nil, errs.New("directory already has a filter: %s", dir)
+	}
+
+	d, err := newDirStorage(dir)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	return NewStorage(d, bits, opts)
+}
+
+// OpenDir is like OpenOptions but opens a filter written by NewDir.
+func OpenDir(dir string, opts Options) (*casFilter, error) {
+	d, err := newDirStorage(dir)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	return OpenStorage(d, opts)
+}
+
+func (d *dirStorage) path(off int64) string {
+	return filepath.Join(d.dir, fmt.Sprintf("%s%016x", dirLevel, off))
+}
+
+// syncDir syncs the directory so that files created, renamed or removed in
+// it are durable.
+func (d *dirStorage) syncDir() error {
+	fh, err := os.Open(d.dir)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	defer fh.Close()
+
+	return errs.Wrap(fh.Sync())
+}
+
+func (d *dirStorage) Size() (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.size, nil
+}
+
+// Allocate creates a file for the region between the old size and the new
+// size. It cannot shrink the storage.
+func (d *dirStorage) Allocate(size int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if size < d.size {
+		return errs.New("cannot shrink directory storage from %d to %d", d.size, size)
+	} else if size == d.size {
+		return nil
+	}
+
+	fh, err := os.OpenFile(d.path(d.size), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	defer fh.Close()
+
+	if err := fh.Truncate(size - d.size); err != nil {
+		return errs.Wrap(err)
+	}
+	if err := fh.Sync(); err != nil {
+		return errs.Wrap(err)
+	}
+	if err := d.syncDir(); err != nil {
+		return errs.Wrap(err)
+	}
+
+	d.regions[d.size] = size - d.size
+	d.size = size
+	return nil
+}
+
+// Map maps the start of the file for the region starting at off.
+func (d *dirStorage) Map(off, size int64) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if rsize, ok := d.regions[off]; !ok || size > rsize {
+		return nil, errs.New("region [%d, %d) is not the start of a level file", off, off+size)
+	}
+
+	fh, err := os.OpenFile(d.path(off), os.O_RDWR, 0)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	defer fh.Close()
+
+	buf, err := unix.Mmap(int(fh.Fd()), 0, int(size),
+		unix.PROT_WRITE|unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	d.mappings[off] = append(d.mappings[off], buf)
+	return buf, nil
+}
+
+func (d *dirStorage) Sync(buf []byte) error {
+	return errs.Wrap(unix.Msync(buf, unix.MS_SYNC))
+}
+
+// Discard punches a hole in the file for the region starting at off.
+func (d *dirStorage) Discard(off int64, buf []byte) error {
+	fh, err := os.OpenFile(d.path(off), os.O_RDWR, 0)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	defer fh.Close()
+
+	return errs.Wrap(punch(fh, 0, buf))
+}
+
+// Allocated returns the number of bytes of disk used by the level files.
+func (d *dirStorage) Allocated() (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	n := int64(0)
+	for off := range d.regions {
+		fi, err := os.Stat(d.path(off))
+		if err != nil {
+			return 0, errs.Wrap(err)
+		}
+		n += allocated(fi)
+	}
+	return n, nil
+}
+
+func (d *dirStorage) Release() (err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for off := range d.mappings {
+		if merr := d.unmap(off); err == nil {
+			err = merr
+		}
+	}
+	return errs.Wrap(err)
+}
+
+// unmap unmaps the mappings of the region at off. It must be called with mu
+// held.
+func (d *dirStorage) unmap(off int64) (err error) {
+	for _, m := range d.mappings[off] {
+		if merr := unix.Munmap(m); err == nil {
+			err = merr
+		}
+	}
+	delete(d.mappings, off)
+	return errs.Wrap(err)
+}
+
+func (d *dirStorage) readManifest() ([]byte, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(d.dir, dirManifest))
+	return buf, errs.Wrap(err)
+}
+
+func (d *dirStorage) writeManifest(buf []byte) error {
+	tmp := filepath.Join(d.dir, dirManifest+".tmp")
+
+	fh, err := os.Create(tmp)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	if _, err := fh.Write(buf); err != nil {
+		fh.Close()
+		return errs.Wrap(err)
+	}
+	if err := fh.Sync(); err != nil {
+		fh.Close()
+		return errs.Wrap(err)
+	}
+	if err := fh.Close(); err != nil {
+		return errs.Wrap(err)
+	}
+
+	if err := os.Rename(tmp, filepath.Join(d.dir, dirManifest)); err != nil {
+		return errs.Wrap(err)
+	}
+	return d.syncDir()
+}
+
+func (d *dirStorage) free(off int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.remove(off); err != nil {
+		return errs.Wrap(err)
+	}
+	return d.syncDir()
+}
+
+// remove unmaps and removes the region at off. It must be called with mu held.
+func (d *dirStorage) remove(off int64) error {
+	if err := d.unmap(off); err != nil {
+		return errs.Wrap(err)
+	}
+	if err := os.Remove(d.path(off)); err != nil && !os.IsNotExist(err) {
+		return errs.Wrap(err)
+	}
+	delete(d.regions, off)
+	return nil
+}
+
+func (d *dirStorage) prune(live map[int64]bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for off := range d.regions {
+		if !live[off] {
+			if err := d.remove(off); err != nil {
+				return errs.Wrap(err)
+			}
+		}
+	}
+
+	// new regions start after the last live one.
+	d.size = pageSize()
+	for off, size := range d.regions {
+		if off+size > d.size {
+			d.size = off + size
+		}
+	}
+	return d.syncDir()
+}
@@ -0,0 +1,174 @@
+package cascade
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zeebo/assert"
+	"github.com/zeebo/errs"
+	"github.com/zeebo/pcg"
+)
+
+// levelFiles returns the number of level files in the directory.
+func levelFiles(t *testing.T, dir string) int {
+	names, err := filepath.Glob(filepath.Join(dir, dirLevel+"*"))
+	assert.NoError(t, err)
+	return len(names)
+}
+
+// heldLevels returns the number of levels the filter has a file for.
+func heldLevels(cf *casFilter) int {
+	n := len(cf.levels)
+	if cf.frozen.filter != nil {
+		n++
+	}
+	if cf.spare.filter != nil {
+		n++
+	}
+	return n
+}
+
+func TestDir(t *testing.T) {
+	t.Run("Basic", func(t *testing.T) {
+		for _, opts := range []Options{
+			{},
+			{Background: true},
+			{Layout: LayoutRankSelect},
+		} {
+			dir, err := ioutil.TempDir("", "cascade")
+			assert.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			cf, err := NewDir(dir, 20, opts)
+			assert.NoError(t, err)
+
+			var e []uint64
+			for i := 0; i < 20000; i++ {
+				x := pcg.Uint64()
+				e = append(e, x)
+				assert.NoError(t, cf.Add(x))
+			}
+			assert.NoError(t, cf.Flush(context.Background()))
+			assert.That(t, len(cf.levels) > 2)
+
+			// the files of replaced levels are removed by the spills.
+			assert.Equal(t, levelFiles(t, dir), heldLevels(cf))
+			assert.NoError(t, cf.Close())
+
+			_, err = NewDir(dir, 20, opts)
+			assert.Error(t, err)
+
+			cf2, err := OpenDir(dir, opts)
+			assert.NoError(t, err)
+			for _, v := range e {
+				ok, err := cf2.Lookup(v)
+				assert.NoError(t, err)
+				assert.That(t, ok)
+			}
+			assert.NoError(t, cf2.Close())
+		}
+	})
+
+	t.Run("Reopen Empty", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "cascade")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		opts := Options{Layout: LayoutRankSelect, ValueBits: 8}
+		cf, err := NewDir(dir, 20, opts)
+		assert.NoError(t, err)
+		assert.NoError(t, cf.Close())
+
+		// the manifest is written before anything is added.
+		cf2, err := OpenDir(dir, Options{})
+		assert.NoError(t, err)
+		assert.Equal(t, cf2.Len(), uint(0))
+		assert.Equal(t, cf2.layout, LayoutRankSelect)
+		assert.Equal(t, cf2.ValueBits(), uint(8))
+		assert.Equal(t, levelFiles(t, dir), heldLevels(cf2))
+		assert.NoError(t, cf2.Close())
+	})
+
+	t.Run("Crash", func(t *testing.T) {
+		errCrash := errors.New("crash")
+
+		for _, opts := range []Options{
+			{},
+			{Background: true},
+			{Growth: 4},
+			{Growth: 4, Background: true},
+		} {
+			for n := 1; ; n++ {
+				dir, err := ioutil.TempDir("", "cascade")
+				assert.NoError(t, err)
+				defer os.RemoveAll(dir)
+
+				var e []uint64
+				cf, err := NewDir(dir, 20, opts)
+				assert.NoError(t, err)
+				add := func() error {
+					x := pcg.Uint64()
+					if err := cf.Add(x); err != nil {
+						return err
+					}
+					e = append(e, x)
+					return cf.Flush(context.Background())
+				}
+
+				// fill up a couple of levels so that the spill has a prefix, and
+				// with a larger growth, a destination that is not empty.
+				for i := 0; i < 3000 || len(cf.levels) < 3 || cf.levels[1].Empty(); i++ {
+					assert.NoError(t, add())
+				}
+
+				steps := 0
+				cf.step = func() error {
+					steps++
+					if steps == n {
+						return errCrash
+					}
+					return nil
+				}
+
+				for steps == 0 {
+					if err := add(); err != nil {
+						assert.Equal(t, errs.Unwrap(err), errCrash)
+						break
+					}
+				}
+				_ = cf.unmap() // simulate the process dying
+
+				cf2, err := OpenDir(dir, opts)
+				assert.NoError(t, err)
+
+				// any level file from the interrupted spill is removed.
+				assert.Equal(t, levelFiles(t, dir), heldLevels(cf2))
+
+				total := uint(0)
+				for _, l := range cf2.levels {
+					assert.Equal(t, l.Len(), l.count())
+					total += l.Len()
+				}
+				assert.Equal(t, cf2.Len(), total)
+
+				for _, v := range e {
+					ok, err := cf2.Lookup(v)
+					assert.NoError(t, err)
+					assert.That(t, ok)
+				}
+				for i := 0; i < 3000; i++ {
+					assert.NoError(t, cf2.Add(pcg.Uint64()))
+				}
+				assert.NoError(t, cf2.Close())
+
+				if steps < n {
+					break
+				}
+			}
+		}
+	})
+}
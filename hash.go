@@ -0,0 +1,90 @@
+package cascade
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// Hasher hashes keys for AddKey and LookupKey. The ID and seed are recorded
+// in the backing file so that it can be checked that a reopened filter hashes
+// keys the same way.
+type Hasher interface {
+	// ID identifies the hash function. 1 is the default, so other hashers
+	// must use other values.
+	ID() uint32
+
+	// Seed returns the seed the hash function is keyed with.
+	Seed() uint64
+
+	// Hash returns the hash of the key.
+	Hash(key []byte) uint64
+}
+
+// wyHasherID is the ID of the hasher returned by NewHasher.
+const wyHasherID = 1
+
+// NewHasher returns the default Hasher keyed with the seed. It is a port of
+// wyhash final3 with the default secret.
+func NewHasher(seed uint64) Hasher { return wyHasher{seed: seed} }
+
+type wyHasher struct{ seed uint64 }
+
+func (w wyHasher) ID() uint32             { return wyHasherID }
+func (w wyHasher) Seed() uint64           { return w.seed }
+func (w wyHasher) Hash(key []byte) uint64 { return wyhash(key, w.seed) }
+
+const (
+	wyp0 = 0xa0761d6478bd642f
+	wyp1 = 0xe7037ed1a0b428db
+	wyp2 = 0x8ebc6af09c88c6e3
+	wyp3 = 0x589965cc75374cc3
+)
+
+func wymum(a, b uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	return hi ^ lo
+}
+
+func wyr8(p []byte) uint64 { return binary.LittleEndian.Uint64(p) }
+func wyr4(p []byte) uint64 { return uint64(binary.LittleEndian.Uint32(p)) }
+
+func wyr3(p []byte, k int) uint64 {
+	return uint64(p[0])<<16 | uint64(p[k>>1])<<8 | uint64(p[k-1])
+}
+
+func wyhash(key []byte, seed uint64) uint64 {
+	n := len(key)
+	seed ^= wyp0
+
+	var a, b uint64
+	switch {
+	case n > 16:
+		p := key
+		if len(p) > 48 {
+			see1, see2 := seed, seed
+			for len(p) > 48 {
+				seed = wymum(wyr8(p)^wyp1, wyr8(p[8:])^seed)
+				see1 = wymum(wyr8(p[16:])^wyp2, wyr8(p[24:])^see1)
+				see2 = wymum(wyr8(p[32:])^wyp3, wyr8(p[40:])^see2)
+				p = p[48:]
+			}
+			seed ^= see1 ^ see2
+		}
+		for len(p) > 16 {
+			seed = wymum(wyr8(p)^wyp1, wyr8(p[8:])^seed)
+			p = p[16:]
+		}
+
+		// the last 16 bytes of the key, which may overlap what was mixed.
+		a, b = wyr8(key[n-16:]), wyr8(key[n-8:])
+
+	case n >= 4:
+		a = wyr4(key)<<32 | wyr4(key[(n>>3)<<2:])
+		b = wyr4(key[n-4:])<<32 | wyr4(key[n-4-(n>>3)<<2:])
+
+	case n > 0:
+		a = wyr3(key, n)
+	}
+
+	return wymum(wyp1^uint64(n), wymum(a^wyp1, b^seed))
+}
@@ -0,0 +1,66 @@
+package cascade
+
+import (
+	"math/bits"
+	"testing"
+
+	"github.com/zeebo/assert"
+)
+
+func TestHash(t *testing.T) {
+	key := make([]byte, 200)
+	for i := range key {
+		key[i] = byte(i)
+	}
+
+	t.Run("Vectors", func(t *testing.T) {
+		// the test vectors of wyhash final3, where the seed is the index.
+		for i, c := range []struct {
+			key string
+			exp uint64
+		}{
+			{"", 0x42bc986dc5eec4d3},
+			{"a", 0x84508dc903c31551},
+			{"abc", 0x0bc54887cfc9ecb1},
+			{"message digest", 0x6e2ff3298208a67c},
+			{"abcdefghijklmnopqrstuvwxyz", 0x9a64e42e897195b9},
+			{"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789", 0x9199383239c32554},
+			{"12345678901234567890123456789012345678901234567890123456789012345678901234567890", 0x7c1ccf6bba30f5a5},
+		} {
+			assert.Equal(t, wyhash([]byte(c.key), uint64(i)), c.exp)
+		}
+	})
+
+	t.Run("Lengths", func(t *testing.T) {
+		seen := make(map[uint64]bool)
+		for n := 0; n <= len(key); n++ {
+			h := wyhash(key[:n], 0)
+			assert.Equal(t, h, wyhash(key[:n], 0))
+			assert.That(t, !seen[h])
+			seen[h] = true
+		}
+	})
+
+	t.Run("Seed", func(t *testing.T) {
+		for n := 0; n <= len(key); n++ {
+			assert.That(t, wyhash(key[:n], 0) != wyhash(key[:n], 1))
+		}
+	})
+
+	t.Run("Avalanche", func(t *testing.T) {
+		for _, n := range []int{1, 3, 4, 8, 16, 17, 48, 49, 200} {
+			buf := append([]byte(nil), key[:n]...)
+			h := wyhash(buf, 0)
+
+			total := 0
+			for i := 0; i < n*8; i++ {
+				buf[i/8] ^= 1 << uint(i%8)
+				total += bits.OnesCount64(h ^ wyhash(buf, 0))
+				buf[i/8] ^= 1 << uint(i%8)
+			}
+
+			avg := float64(total) / float64(n*8)
+			assert.That(t, avg > 24 && avg < 40)
+		}
+	})
+}
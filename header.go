@@ -0,0 +1,227 @@
+package cascade
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/zeebo/errs"
+)
+
+//
+// the first page of the backing file holds two header slots, one in each
+// half of the page. a header is committed by writing it into the slot that
+// does not hold the current generation and syncing the page, so a torn write
+// can only ever damage the older of the two. all fields are little endian and
+// the layout of a slot is
+//
+// | 8 bytes magic          |
+// | 4 bytes format version |
+// | 4 bytes page size      |
+// | 4 bytes hash bits      |
+// | 4 bytes level count    |
+// | 8 bytes generation     |
+// | 4 bytes hasher id      |
+// | 8 bytes hasher seed    |
+// | 2 bytes quotient bits  |
+// | 2 bytes remainder bits |
+// | 4 bytes flags          | * level count
+// | 8 bytes length         |
+// | 8 bytes file offset    |
+// | 4 bytes crc32c         |
+//
+// levels are stored after the header page, each rounded up to the page size.
+// a live level is one that is modified without updating the header, so its
+// length is recomputed from the slots when the file is opened. a dirty level
+// is empty but may hold garbage from an interrupted spill, either because the
+// spill was writing into it or had emptied it without clearing it yet, and is
+// cleared when the file is opened. space between levels that the header does
+// not refer to held a level replaced by a spill. it is discarded after the
+// header replacing it is committed, and is otherwise unused. a spare level is
+// the second buffer for level 0 used by background spills. when it is live,
+// it holds the previous level 0 that is being spilled.
+//
+// the low byte of the level flags holds the live, spare, counting and dirty
+// bits, the next byte holds the layout of the level, and the byte after that
+// holds the number of value bits stored with every remainder.
+//
+
+const (
+	headerMagic   = "cascade\x00"
+	headerVersion = 2
+
+	headerFixed = 8 + 4 + 4 + 4 + 4 + 8 + 4 + 8
+	headerLevel = 2 + 2 + 4 + 8 + 8
+	headerCRC   = 4
+
+	levelLive        = 1 << 0
+	levelSpare       = 1 << 1
+	levelCounting    = 1 << 2
+	levelDirty       = 1 << 3
+	levelLayoutShift = 8
+	levelLayoutMask  = 0xff << levelLayoutShift
+	levelValueShift  = 16
+	levelValueMask   = 0xff << levelValueShift
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type levelHeader struct {
+	q, r     uint
+	v        uint
+	live     bool
+	spare    bool
+	counting bool
+	dirty    bool
+	layout   Layout
+	len      uint
+	offset   int64
+}
+
+type header struct {
+	version    uint32
+	pageSize   int64
+	bits       uint
+	generation uint64
+	hasher     uint32
+	seed       uint64
+	levels     []levelHeader
+}
+
+func (h *header) size() int { return headerFixed + headerLevel*len(h.levels) + headerCRC }
+
+// headerSlot returns the part of the header page that holds the header for
+// the given generation.
+func headerSlot(page []byte, generation uint64) []byte {
+	half := len(page) / 2
+	if generation%2 == 0 {
+		return page[:half]
+	}
+	return page[half:]
+}
+
+// marshal writes the header into buf, which must be large enough.
+func (h *header) marshal(buf []byte) {
+	le := binary.LittleEndian
+
+	copy(buf[0:8], headerMagic)
+	le.PutUint32(buf[8:], h.version)
+	le.PutUint32(buf[12:], uint32(h.pageSize))
+	le.PutUint32(buf[16:], uint32(h.bits))
+	le.PutUint32(buf[20:], uint32(len(h.levels)))
+	le.PutUint64(buf[24:], h.generation)
+	le.PutUint32(buf[32:], h.hasher)
+	le.PutUint64(buf[36:], h.seed)
+
+	b := buf[headerFixed:]
+	for _, lh := range h.levels {
+		flags := uint32(lh.layout)<<levelLayoutShift | uint32(lh.v)<<levelValueShift
+		if lh.live {
+			flags |= levelLive
+		}
+		if lh.spare {
+			flags |= levelSpare
+		}
+		if lh.counting {
+			flags |= levelCounting
+		}
+		if lh.dirty {
+			flags |= levelDirty
+		}
+
+		le.PutUint16(b[0:], uint16(lh.q))
+		le.PutUint16(b[2:], uint16(lh.r))
+		le.PutUint32(b[4:], flags)
+		le.PutUint64(b[8:], uint64(lh.len))
+		le.PutUint64(b[16:], uint64(lh.offset))
+		b = b[headerLevel:]
+	}
+
+	n := h.size() - headerCRC
+	le.PutUint32(buf[n:], crc32.Checksum(buf[:n], crcTable))
+}
+
+// parseHeader reads a header out of buf, validating it.
+func parseHeader(buf []byte) (h header, err error) {
+	le := binary.LittleEndian
+
+	if len(buf) < headerFixed+headerCRC {
+		return h, errs.New("header too short")
+	}
+	if string(buf[0:8]) != headerMagic {
+		return h, errs.New("header has invalid magic: %q", buf[0:8])
+	}
+
+	h.version = le.Uint32(buf[8:])
+	h.pageSize = int64(le.Uint32(buf[12:]))
+	h.bits = uint(le.Uint32(buf[16:]))
+	count := uint64(le.Uint32(buf[20:]))
+	h.generation = le.Uint64(buf[24:])
+	h.hasher = le.Uint32(buf[32:])
+	h.seed = le.Uint64(buf[36:])
+
+	if h.version != headerVersion {
+		return h, errs.New("header has unknown version: %d", h.version)
+	}
+	if h.pageSize < int64(len(buf)) || h.pageSize&(h.pageSize-1) != 0 {
+		return h, errs.New("header has invalid page size: %d", h.pageSize)
+	}
+	if count > uint64(len(buf)-headerFixed-headerCRC)/headerLevel {
+		return h, errs.New("header has invalid level count: %d", count)
+	}
+
+	h.levels = make([]levelHeader, count)
+	n := h.size() - headerCRC
+	if got, exp := crc32.Checksum(buf[:n], crcTable), le.Uint32(buf[n:]); got != exp {
+		return h, errs.New("header has invalid checksum: %08x != %08x", got, exp)
+	}
+
+	b := buf[headerFixed:]
+	for i := range h.levels {
+		flags := le.Uint32(b[4:])
+		lh := levelHeader{
+			q:        uint(le.Uint16(b[0:])),
+			r:        uint(le.Uint16(b[2:])),
+			v:        uint(flags & levelValueMask >> levelValueShift),
+			live:     flags&levelLive != 0,
+			spare:    flags&levelSpare != 0,
+			counting: flags&levelCounting != 0,
+			dirty:    flags&levelDirty != 0,
+			layout:   Layout(flags & levelLayoutMask >> levelLayoutShift),
+			len:      uint(le.Uint64(b[8:])),
+			offset:   int64(le.Uint64(b[16:])),
+		}
+		b = b[headerLevel:]
+
+		if lh.q+lh.r != h.bits || lh.q >= 64 || lh.len > 1<<lh.q ||
+			flags&^(levelLive|levelSpare|levelCounting|levelDirty|levelLayoutMask|levelValueMask) != 0 ||
+			lh.layout.validate() != nil || lh.v > maxValueBits ||
+			lh.offset < h.pageSize || lh.offset%h.pageSize != 0 {
+			return h, errs.New("header has invalid level %d: q:%d r:%d flags:%x len:%d offset:%d",
+				i, lh.q, lh.r, flags, lh.len, lh.offset)
+		}
+
+		h.levels[i] = lh
+	}
+
+	return h, nil
+}
+
+// readHeader returns the valid header with the largest generation out of
+// the two slots in the header page.
+func readHeader(page []byte) (h header, err error) {
+	h0, err0 := parseHeader(headerSlot(page, 0))
+	h1, err1 := parseHeader(headerSlot(page, 1))
+
+	switch {
+	case err0 != nil && err1 != nil:
+		return h, errs.New("no valid header: %v: %v", err0, err1)
+	case err0 != nil:
+		return h1, nil
+	case err1 != nil:
+		return h0, nil
+	case h1.generation > h0.generation:
+		return h1, nil
+	default:
+		return h0, nil
+	}
+}
@@ -0,0 +1,99 @@
+package cascade
+
+import (
+	"testing"
+
+	"github.com/zeebo/assert"
+)
+
+func TestHeader(t *testing.T) {
+	h := header{
+		version:    headerVersion,
+		pageSize:   4096,
+		bits:       20,
+		generation: 5,
+		hasher:     wyHasherID,
+		seed:       0x0123456789abcdef,
+		levels: []levelHeader{
+			{q: 11, r: 9, live: true, len: 100, offset: 4096},
+			{q: 11, r: 9, dirty: true, len: 0, offset: 8192},
+			{q: 12, r: 8, counting: true, len: 3000, offset: 12288},
+			{q: 12, r: 8, v: 16, layout: LayoutRankSelect, offset: 28672},
+		},
+	}
+
+	t.Run("Roundtrip", func(t *testing.T) {
+		buf := make([]byte, 4096)
+		h.marshal(buf)
+
+		got, err := parseHeader(buf)
+		assert.NoError(t, err)
+		assert.DeepEqual(t, got, h)
+	})
+
+	t.Run("Corrupt", func(t *testing.T) {
+		buf := make([]byte, 4096)
+		for i := 0; i < h.size(); i++ {
+			h.marshal(buf)
+			buf[i] ^= 0x10
+
+			_, err := parseHeader(buf)
+			assert.Error(t, err)
+		}
+	})
+
+	t.Run("Invalid Level", func(t *testing.T) {
+		bad := h
+		bad.levels = []levelHeader{{q: 11, r: 10, offset: 4096}}
+
+		buf := make([]byte, 4096)
+		bad.marshal(buf)
+
+		_, err := parseHeader(buf)
+		assert.Error(t, err)
+	})
+
+	t.Run("Invalid Layout", func(t *testing.T) {
+		bad := h
+		bad.levels = []levelHeader{{q: 11, r: 9, layout: 7, offset: 4096}}
+
+		buf := make([]byte, 4096)
+		bad.marshal(buf)
+
+		_, err := parseHeader(buf)
+		assert.Error(t, err)
+	})
+
+	t.Run("Invalid Values", func(t *testing.T) {
+		bad := h
+		bad.levels = []levelHeader{{q: 11, r: 9, v: 33, offset: 4096}}
+
+		buf := make([]byte, 4096)
+		bad.marshal(buf)
+
+		_, err := parseHeader(buf)
+		assert.Error(t, err)
+	})
+
+	t.Run("Generations", func(t *testing.T) {
+		page := make([]byte, 4096)
+		h0, h1 := h, h
+		h0.generation, h1.generation = 6, 7
+
+		h0.marshal(headerSlot(page, h0.generation))
+		got, err := readHeader(page)
+		assert.NoError(t, err)
+		assert.Equal(t, got.generation, uint64(6))
+
+		h1.marshal(headerSlot(page, h1.generation))
+		got, err = readHeader(page)
+		assert.NoError(t, err)
+		assert.Equal(t, got.generation, uint64(7))
+
+		// a torn write of the newer slot falls back to the older one
+		headerSlot(page, h1.generation)[40] ^= 0xff
+		got, err = readHeader(page)
+		assert.NoError(t, err)
+		assert.Equal(t, got.generation, uint64(6))
+	})
+}
@@ -0,0 +1,111 @@
+package cascade
+
+import "github.com/zeebo/errs"
+
+// Iterator walks every fingerprint in a filter once in sorted order. Every
+// level keeps the same number of hash bits, so the fingerprints of all of the
+// levels are the same width. It only holds a read lock on the filter during
+// calls to Next and Seek, so the filter may be used and written to while it
+// is open. If the levels change between calls, it continues on the new levels
+// past the last fingerprint it yielded, so fingerprints added or removed in
+// the meantime may or may not be yielded, but every other one is yielded once.
+type Iterator struct {
+	c       *casFilter
+	it      *mergeIter
+	changes uint64 // the changes to the levels when it was loaded
+	from    uint64 // the smallest fingerprint Next may yield
+	err     error
+	done    bool
+	closed  bool
+}
+
+// Iter returns an Iterator over the fingerprints in the filter. If the filter
+// is stored with values, the value is from the newest level with the
+// fingerprint.
+func (c *casFilter) Iter() *Iterator {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.closed {
+		return &Iterator{err: errs.New("filter closed"), done: true}
+	}
+	return &Iterator{c: c, it: newMergeIter(c.iters(), c.counting), changes: c.changes}
+}
+
+// load reloads the levels if they changed since the last call, reporting
+// false and stopping the iteration if the filter is closed. It must be called
+// with the read lock held.
+func (it *Iterator) load() bool {
+	c := it.c
+	if c.closed {
+		it.err, it.done = errs.New("filter closed"), true
+		return false
+	}
+	if it.changes != c.changes {
+		it.it = newMergeIter(c.iters(), c.counting)
+		it.it.Seek(it.from)
+		it.changes = c.changes
+	}
+	return true
+}
+
+// Next advances to the next fingerprint, reporting false once there are no
+// more.
+func (it *Iterator) Next() bool {
+	if it.done {
+		return false
+	}
+
+	it.c.mu.RLock()
+	defer it.c.mu.RUnlock()
+
+	if !it.load() {
+		return false
+	}
+	if !it.it.Next() {
+		it.done = true
+		return false
+	}
+
+	// nothing is past the largest fingerprint, and seeking past it would
+	// wrap around to the start.
+	it.from = it.it.Hash() + 1
+	it.done = it.from == uint64(1)<<(it.c.q+it.c.r)
+	return true
+}
+
+// Seek moves the iterator so that Next yields the fingerprints at least hash,
+// which is truncated to the hash bits of the filter. Seeking and stopping once
+// the fingerprints pass the end of a range scans the range. An exhausted
+// iterator continues from the hash, but it has no effect once the iterator is
+// closed or stopped by an error.
+func (it *Iterator) Seek(hash uint64) {
+	if it.closed || it.err != nil {
+		return
+	}
+
+	it.c.mu.RLock()
+	defer it.c.mu.RUnlock()
+
+	if it.load() {
+		it.from = hash & (uint64(1)<<(it.c.q+it.c.r) - 1)
+		it.it.Seek(it.from)
+		it.done = false
+	}
+}
+
+// Hash returns the current fingerprint.
+func (it *Iterator) Hash() uint64 { return it.it.Hash() }
+
+// Value returns the value stored with the current fingerprint.
+func (it *Iterator) Value() uint64 { return it.it.Value() }
+
+// Count returns the number of times the current fingerprint was added across
+// every level, which is one unless the filter is counting.
+func (it *Iterator) Count() uint64 { return it.it.Count() }
+
+// Err returns any error that stopped the iteration.
+func (it *Iterator) Err() error { return it.err }
+
+// Close stops the iteration. It is safe to call more than once.
+func (it *Iterator) Close() { it.done, it.closed = true, true }
@@ -0,0 +1,150 @@
+package cascade
+
+import (
+	"testing"
+
+	"github.com/zeebo/assert"
+	"github.com/zeebo/pcg"
+)
+
+func TestIterator(t *testing.T) {
+	t.Run("Sorted", func(t *testing.T) {
+		for _, bg := range []bool{false, true} {
+			cf, done := tempFilter(t, 20, Options{Background: bg, ValueBits: 16})
+			defer done()
+
+			// the fingerprints are the low 20 bits, and some are added
+			// again after they have been spilled to deeper levels.
+			e := make(map[uint64]uint64)
+			for i := uint64(0); i < 20000; i++ {
+				x := pcg.Uint64()
+				if i%10 == 0 {
+					for y := range e {
+						x = y
+						break
+					}
+				}
+				assert.NoError(t, cf.AddValue(x, i&0xffff))
+				e[x&(1<<20-1)] = i & 0xffff
+			}
+
+			n, last := 0, uint64(0)
+			it := cf.Iter()
+			for ; it.Next(); n++ {
+				assert.That(t, n == 0 || it.Hash() > last)
+				v, ok := e[it.Hash()]
+				assert.That(t, ok)
+				assert.Equal(t, it.Value(), v)
+				last = it.Hash()
+			}
+			assert.NoError(t, it.Err())
+			assert.Equal(t, n, len(e))
+		}
+	})
+
+	t.Run("Seek", func(t *testing.T) {
+		cf, done := tempFilter(t, 20, Options{Layout: LayoutRankSelect})
+		defer done()
+
+		e := make(map[uint64]bool)
+		for i := 0; i < 20000; i++ {
+			x := pcg.Uint64()
+			assert.NoError(t, cf.Add(x))
+			e[x&(1<<20-1)] = true
+		}
+
+		// scan a few ranges of the keyspace.
+		for i := 0; i < 10; i++ {
+			lo := pcg.Uint64() & (1<<20 - 1)
+			hi := lo + 1<<16
+
+			n := 0
+			it := cf.Iter()
+			for it.Seek(lo); it.Next() && it.Hash() < hi; n++ {
+				assert.That(t, it.Hash() >= lo)
+				assert.That(t, e[it.Hash()])
+			}
+			it.Close()
+
+			exp := 0
+			for x := range e {
+				if x >= lo && x < hi {
+					exp++
+				}
+			}
+			assert.Equal(t, n, exp)
+		}
+
+		// an exhausted iterator starts over from a seek, unless it is closed.
+		it := cf.Iter()
+		for it.Next() {
+		}
+		it.Seek(0)
+		assert.That(t, it.Next())
+		it.Close()
+		it.Seek(0)
+		assert.That(t, !it.Next())
+	})
+
+	t.Run("Writes", func(t *testing.T) {
+		for _, bg := range []bool{false, true} {
+			cf, done := tempFilter(t, 20, Options{Background: bg})
+			defer done()
+
+			e := make(map[uint64]bool)
+			for i := 0; i < 5000; i++ {
+				x := pcg.Uint64()
+				assert.NoError(t, cf.Add(x))
+				e[x&(1<<20-1)] = true
+			}
+
+			// an iterator holds no lock between calls, so one that is
+			// abandoned does not block writers, and the filter can be read
+			// and written inside the loop. the writes spill the levels out
+			// from under the iterator, and it still yields every
+			// fingerprint from before it started once and in order.
+			abandoned := cf.Iter()
+			assert.That(t, abandoned.Next())
+
+			n, last := 0, uint64(0)
+			it := cf.Iter()
+			for i := 0; it.Next(); i++ {
+				assert.That(t, i == 0 || it.Hash() > last)
+				last = it.Hash()
+				if e[it.Hash()] {
+					n++
+				}
+
+				ok, err := cf.Lookup(it.Hash())
+				assert.NoError(t, err)
+				assert.That(t, ok)
+				assert.NoError(t, cf.Add(pcg.Uint64()))
+			}
+			assert.NoError(t, it.Err())
+			assert.Equal(t, n, len(e))
+			assert.That(t, cf.Len() > 10000)
+		}
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		cf, done := tempFilter(t, 20, Options{})
+		defer done()
+
+		for i := 0; i < 1000; i++ {
+			assert.NoError(t, cf.Add(pcg.Uint64()))
+		}
+
+		// closing early stops the iteration.
+		it := cf.Iter()
+		assert.That(t, it.Next())
+		it.Close()
+		it.Close()
+		assert.That(t, !it.Next())
+		assert.NoError(t, cf.Add(pcg.Uint64()))
+
+		assert.NoError(t, cf.Close())
+		it = cf.Iter()
+		assert.That(t, !it.Next())
+		assert.Error(t, it.Err())
+	})
+}
@@ -0,0 +1,153 @@
+package cascade
+
+import (
+	"math"
+	"math/bits"
+
+	"github.com/zeebo/errs"
+)
+
+// Layout selects how the slots of every level in a filter are stored.
+type Layout uint8
+
+const (
+	// LayoutQuotient stores each slot as a remainder and 3 metadata bits.
+	LayoutQuotient Layout = iota
+
+	// LayoutRankSelect stores blocks of 64 slots with an offset and two bit
+	// vectors, using about 2.125 metadata bits per slot. Lookups find runs
+	// with rank and select instead of walking clusters.
+	LayoutRankSelect
+)
+
+const (
+	// maxValueBits is the most bits a value may have.
+	maxValueBits = 32
+
+	// maxSlotBits is the most bits of remainder and value a slot may have. a
+	// bitReader holds at most 56 bits, and quotient slots use 3 of them for
+	// metadata.
+	maxSlotBits = 53
+)
+
+// validate returns an error if the layout is unknown.
+func (l Layout) validate() error {
+	if l > LayoutRankSelect {
+		return errs.New("unknown layout: %d", l)
+	}
+	return nil
+}
+
+// size returns the size of the buffer for a level with the given bits. The v
+// bits from slotBits are stored above the remainder, so a slot is as wide as
+// one with a remainder of r+v bits.
+func (l Layout) size(q, r, v uint) uint64 {
+	if l == LayoutRankSelect {
+		return rsqfSize(q, r+v)
+	}
+	return uint64(bufSize(q, r+v))
+}
+
+// bytes is like size but does not overflow for very large levels.
+func (l Layout) bytes(q, r, v uint) float64 {
+	if l == LayoutRankSelect {
+		blocks := math.Ceil(math.Ldexp(1, int(q))/64) + rsqfExtra
+		return blocks * float64(17+8*(r+v))
+	}
+	return math.Ldexp(float64(3+r+v), int(q)) / 8
+}
+
+// filter is a single level of the cascade, stored in a buffer with some
+// layout.
+type filter interface {
+	// Add adds the hash, reporting false if there was no room for it.
+	Add(hash uint64) bool
+	Remove(hash uint64) bool
+	Lookup(hash uint64) bool
+	Count(hash uint64) uint64
+
+	// AddValue is like Add but stores the value with the hash, replacing
+	// the value if the hash is already present. Add stores a zero value.
+	// AddCount is like AddValue but adds the hash n times if the filter is
+	// counting. They report false without changing the filter if there is
+	// no room for the hash.
+	AddValue(hash, value uint64) bool
+	AddCount(hash, value, n uint64) bool
+	Get(hash uint64) (uint64, bool)
+
+	Iter() iterator
+	Len() uint
+	Cap() uint
+	Clear()
+
+	Empty() bool
+	Bits() uint
+	QuotientBits() uint
+	RemainderBits() uint
+
+	// buffer returns the buffer the slots are stored in.
+	buffer() []byte
+
+	// setLen sets the length for a buffer filled by some other filter, and
+	// count recomputes it by scanning the buffer. The length is the number
+	// of slots in use, which includes the counter slots.
+	setLen(n uint)
+	count() uint
+
+	// builder returns a builder that fills the empty filter.
+	builder() builder
+}
+
+// iterator walks hashes in sorted order along with their values and the
+// number of times they were added. Seek moves it so that Next yields the
+// hashes at least the given hash.
+type iterator interface {
+	Next() bool
+	Hash() uint64
+	Value() uint64
+	Count() uint64
+	Seek(hash uint64)
+}
+
+// builder fills an empty filter from hashes given in sorted order, each
+// added the given number of times.
+type builder interface {
+	Add(hash, value, n uint64) bool
+}
+
+// newFilter returns a filter with the layout over the buffer that stores
+// values of v bits. A counting filter stores the number of times a hash was
+// added in counter slots after it.
+func newFilter(l Layout, counting bool, q, r, v uint, buf []byte) filter {
+	switch {
+	case l == LayoutRankSelect && counting:
+		return newCountingRSQFil(q, r, v, buf)
+	case l == LayoutRankSelect:
+		return newRSQFil(q, r, v, buf)
+	case counting:
+		return newCountingQuoFil(q, r, v, buf)
+	default:
+		return newQuoFil(q, r, v, buf)
+	}
+}
+
+// slotBits returns the bits stored above the remainder in every slot of a
+// filter with values of v bits. A counting filter has one more to mark its
+// counter slots.
+func slotBits(v uint, counting bool) uint {
+	if counting {
+		return v + 1
+	}
+	return v
+}
+
+// counterSlots returns the number of counter slots with digits of d bits
+// needed to hold n.
+func counterSlots(n uint64, d uint) uint {
+	return (uint(bits.Len64(n)) + d - 1) / d
+}
+
+// counterDigit returns the ith digit of n in the counter slots.
+func counterDigit(n uint64, d, i uint) uint64 {
+	return n >> (i * d) & (1<<d - 1)
+}
@@ -0,0 +1,235 @@
+package cascade
+
+import (
+	"github.com/zeebo/errs"
+	"github.com/zeebo/mon"
+)
+
+// mergeIter yields the union of a set of sorted iterators in sorted order.
+// Hashes that appear more than once are yielded once with the value from the
+// first iterator that has them. If sum is set, the count is the sum of the
+// counts from every iterator, and otherwise it is one.
+type mergeIter struct {
+	its   []iterator
+	ok    []bool
+	sum   bool
+	hash  uint64
+	value uint64
+	count uint64
+}
+
+func newMergeIter(its []iterator, sum bool) *mergeIter {
+	m := &mergeIter{
+		its: its,
+		ok:  make([]bool, len(its)),
+		sum: sum,
+	}
+	for i := range m.its {
+		m.ok[i] = m.its[i].Next()
+	}
+	return m
+}
+
+func (m *mergeIter) Next() bool {
+	found, min := false, 0
+	for i := range m.its {
+		if m.ok[i] && (!found || m.its[i].Hash() < m.hash) {
+			m.hash, found, min = m.its[i].Hash(), true, i
+		}
+	}
+	if !found {
+		return false
+	}
+	m.value, m.count = m.its[min].Value(), 1
+
+	if m.sum {
+		m.count = 0
+	}
+	for i := range m.its {
+		for m.ok[i] && m.its[i].Hash() == m.hash {
+			if m.sum {
+				m.count += m.its[i].Count()
+			}
+			m.ok[i] = m.its[i].Next()
+		}
+	}
+	return true
+}
+
+// Seek moves every iterator so that Next yields the hashes at least hash.
+func (m *mergeIter) Seek(hash uint64) {
+	for i := range m.its {
+		m.its[i].Seek(hash)
+		m.ok[i] = m.its[i].Next()
+	}
+}
+
+func (m *mergeIter) Hash() uint64  { return m.hash }
+func (m *mergeIter) Value() uint64 { return m.value }
+func (m *mergeIter) Count() uint64 { return m.count }
+
+// intersectIter yields the hashes that every one of a set of sorted iterators
+// has in sorted order, once each and with the value from the first of them.
+// The iterators must not yield a hash more than once.
+type intersectIter struct {
+	its   []iterator
+	hash  uint64
+	value uint64
+}
+
+func newIntersectIter(its []iterator) *intersectIter {
+	return &intersectIter{its: its}
+}
+
+func (m *intersectIter) Next() bool {
+	if len(m.its) == 0 {
+		return false
+	}
+	for _, it := range m.its {
+		if !it.Next() {
+			return false
+		}
+	}
+
+	for {
+		max, same := m.its[0].Hash(), true
+		for _, it := range m.its[1:] {
+			if h := it.Hash(); h != max {
+				same = false
+				if h > max {
+					max = h
+				}
+			}
+		}
+		if same {
+			m.hash, m.value = max, m.its[0].Value()
+			return true
+		}
+
+		// every iterator behind the largest hash skips up to it.
+		for _, it := range m.its {
+			for it.Hash() < max {
+				if !it.Next() {
+					return false
+				}
+			}
+		}
+	}
+}
+
+// Seek moves every iterator so that Next yields the hashes at least hash.
+func (m *intersectIter) Seek(hash uint64) {
+	for _, it := range m.its {
+		it.Seek(hash)
+	}
+}
+
+func (m *intersectIter) Hash() uint64  { return m.hash }
+func (m *intersectIter) Value() uint64 { return m.value }
+func (m *intersectIter) Count() uint64 { return 1 }
+
+// Merge adds every hash in the srcs to dst by streaming the sorted levels of
+// each of them. The srcs must have at least as many hash bits as dst, and
+// their hashes are truncated to the bits of dst. If dst stores values, the
+// srcs must store values of the same size, and the newest value for a hash in
+// a src is kept. If dst and a src are both counting, the counts in the src
+// are added to dst. The srcs are streamed with an Iterator, so they may be
+// used and written to during the merge. If an error is returned, dst may have
+// some of the hashes.
+func Merge(dst *casFilter, srcs ...*casFilter) (err error) {
+	defer mon.Start().Stop(&err)
+
+	for i, src := range srcs {
+		if err := checkCombine(dst, src, i); err != nil {
+			return errs.Wrap(err)
+		}
+	}
+
+	for _, src := range srcs {
+		it := src.Iter()
+		err := addAll(dst, it)
+		it.Close()
+		if err == nil {
+			err = it.Err()
+		}
+		if err != nil {
+			return errs.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// Intersect adds to dst every hash that is in all of the srcs, with the value
+// from the first of them. The srcs must all have the same hash bits, which
+// must be at least as many as dst, and their hashes are truncated to the bits
+// of dst. If dst stores values, the srcs must store values of the same size.
+// Like Merge, the srcs are streamed with an Iterator. If an error is
+// returned, dst may have some of the hashes.
+func Intersect(dst *casFilter, srcs ...*casFilter) (err error) {
+	defer mon.Start().Stop(&err)
+
+	// a filter listed twice does not change the intersection, so it is only
+	// streamed once.
+	var uniq []*casFilter
+	seen := make(map[*casFilter]bool)
+	for i, src := range srcs {
+		if err := checkCombine(dst, src, i); err != nil {
+			return errs.Wrap(err)
+		}
+		if bits, first := src.hashBits(), srcs[0].hashBits(); bits != first {
+			return errs.New("filter %d has %d hash bits but filter 0 has %d", i, bits, first)
+		}
+		if !seen[src] {
+			uniq, seen[src] = append(uniq, src), true
+		}
+	}
+
+	// intersect the union of the levels of each src.
+	iters := make([]*Iterator, 0, len(uniq))
+	its := make([]iterator, 0, len(uniq))
+	for _, src := range uniq {
+		it := src.Iter()
+		iters, its = append(iters, it), append(its, it)
+	}
+
+	err = addAll(dst, newIntersectIter(its))
+	for _, it := range iters {
+		it.Close()
+		if err == nil {
+			err = it.Err()
+		}
+	}
+	return errs.Wrap(err)
+}
+
+// checkCombine returns an error if the hashes of the ith src cannot be added
+// to dst.
+func checkCombine(dst, src *casFilter, i int) error {
+	switch {
+	case dst == src:
+		return errs.New("filter %d is the destination", i)
+	case src.hashBits() < dst.hashBits():
+		return errs.New("filter %d has %d hash bits, fewer than the %d of the destination",
+			i, src.hashBits(), dst.hashBits())
+	case dst.vbits != 0 && src.vbits != dst.vbits:
+		return errs.New("filter %d has %d value bits but the destination has %d",
+			i, src.vbits, dst.vbits)
+	}
+	return nil
+}
+
+// addAll adds every hash from the iterator to dst, truncated to its bits, as
+// many times as the iterator counts it.
+func addAll(dst *casFilter, it iterator) error {
+	mask := uint64(1)<<dst.hashBits() - 1
+	for it.Next() {
+		value := uint64(0)
+		if dst.vbits != 0 {
+			value = it.Value()
+		}
+		if err := dst.addCount(it.Hash()&mask, value, it.Count()); err != nil {
+			return errs.Wrap(err)
+		}
+	}
+	return nil
+}
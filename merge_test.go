@@ -0,0 +1,194 @@
+package cascade
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/zeebo/assert"
+	"github.com/zeebo/pcg"
+)
+
+func TestMerge(t *testing.T) {
+	t.Run("Union", func(t *testing.T) {
+		e := make(map[uint64]bool)
+		var its []iterator
+
+		for _, qr := range [][2]uint{{10, 8}, {10, 8}, {11, 7}} {
+			q := newQuoFil(qr[0], qr[1], 0, nil)
+			for i := 0; i < 700; i++ {
+				x := pcg.Uint64() & (1<<18 - 1)
+				if i%3 == 0 && len(e) > 0 {
+					for v := range e {
+						x = v
+						break
+					}
+				}
+				e[x] = true
+				q.Add(x)
+			}
+			its = append(its, q.Iter())
+		}
+
+		n, last := 0, uint64(0)
+		for it := newMergeIter(its, false); it.Next(); n++ {
+			assert.That(t, n == 0 || it.Hash() > last)
+			assert.That(t, e[it.Hash()])
+			last = it.Hash()
+		}
+		assert.Equal(t, n, len(e))
+	})
+
+	t.Run("Duplicates", func(t *testing.T) {
+		e := make(map[uint64]int)
+		var its []iterator
+
+		for i := 0; i < 3; i++ {
+			q := newCountingQuoFil(10, 8, 0, nil)
+			for j := 0; j < 700; j++ {
+				x := pcg.Uint64() & (1<<18 - 1)
+				if j%2 == 0 && len(e) > 0 {
+					for v := range e {
+						x = v
+						break
+					}
+				}
+				e[x]++
+				q.Add(x)
+			}
+			its = append(its, q.Iter())
+		}
+
+		// every hash is yielded once with the counts from every iterator.
+		got := make(map[uint64]int)
+		n, last := 0, uint64(0)
+		for it := newMergeIter(its, true); it.Next(); {
+			assert.That(t, n == 0 || it.Hash() > last)
+			got[it.Hash()] += int(it.Count())
+			n += int(it.Count())
+			last = it.Hash()
+		}
+		assert.Equal(t, n, 3*700)
+		assert.DeepEqual(t, got, e)
+	})
+
+	t.Run("Values", func(t *testing.T) {
+		// iterator i has the multiples of 3-i with a value of i.
+		var its []iterator
+		for i := uint64(0); i < 3; i++ {
+			q := newQuoFil(10, 8, 4, nil)
+			for x := uint64(0); x < 600; x += 3 - i {
+				q.AddValue(x, i)
+			}
+			its = append(its, q.Iter())
+		}
+
+		// the value comes from the first iterator with the hash.
+		n := uint64(0)
+		for it := newMergeIter(its, false); it.Next(); n++ {
+			assert.Equal(t, it.Hash(), n)
+			switch {
+			case n%3 == 0:
+				assert.Equal(t, it.Value(), uint64(0))
+			case n%2 == 0:
+				assert.Equal(t, it.Value(), uint64(1))
+			default:
+				assert.Equal(t, it.Value(), uint64(2))
+			}
+		}
+		assert.Equal(t, n, uint64(600))
+	})
+
+	t.Run("Intersect", func(t *testing.T) {
+		// iterator i has the multiples of i+2.
+		var its []iterator
+		for i := uint64(0); i < 3; i++ {
+			q := newQuoFil(10, 8, 0, nil)
+			for x := uint64(0); x < 600; x += i + 2 {
+				q.Add(x)
+			}
+			its = append(its, q.Iter())
+		}
+
+		n := uint64(0)
+		for it := newIntersectIter(its); it.Next(); n++ {
+			assert.Equal(t, it.Hash(), 12*n)
+		}
+		assert.Equal(t, n, uint64(50))
+	})
+
+	t.Run("Filters", func(t *testing.T) {
+		// distinct in the low 20 bits, so no two share a fingerprint.
+		hash := func(i uint64) uint64 { return i*0x9e3779b1&(1<<20-1) | pcg.Uint64()<<20 }
+
+		// every filter has the first 1000 hashes and 3000 of its own.
+		var srcs []*casFilter
+		for i := uint64(0); i < 3; i++ {
+			cf, done := tempFilter(t, 20+2*uint(i), Options{ValueBits: 8})
+			defer done()
+
+			for j := uint64(0); j < 1000; j++ {
+				assert.NoError(t, cf.AddValue(hash(j), i))
+			}
+			for j := uint64(0); j < 3000; j++ {
+				assert.NoError(t, cf.AddValue(hash(1000+3000*i+j), i))
+			}
+			srcs = append(srcs, cf)
+		}
+
+		union, done := tempFilter(t, 20, Options{ValueBits: 8})
+		defer done()
+		assert.NoError(t, Merge(union, srcs...))
+		for j := uint64(0); j < 10000; j++ {
+			v, ok, err := union.Get(hash(j))
+			assert.NoError(t, err)
+			assert.That(t, ok)
+			if j >= 1000 {
+				assert.Equal(t, v, (j-1000)/3000)
+			}
+		}
+
+		// hashes are only truncated, so the srcs must have the same bits.
+		inter, done := tempFilter(t, 20, Options{})
+		defer done()
+		assert.Error(t, Intersect(inter, srcs...))
+		assert.NoError(t, Intersect(inter, union, srcs[0], srcs[0]))
+		assert.Equal(t, inter.Len(), uint(4000))
+		for j := uint64(0); j < 10000; j++ {
+			ok, err := inter.Lookup(hash(j))
+			assert.NoError(t, err)
+			assert.Equal(t, ok, j < 4000)
+		}
+	})
+
+	t.Run("Incompatible", func(t *testing.T) {
+		dst, done := tempFilter(t, 22, Options{ValueBits: 8})
+		defer done()
+		narrow, done := tempFilter(t, 20, Options{ValueBits: 8})
+		defer done()
+		other, done := tempFilter(t, 22, Options{ValueBits: 4})
+		defer done()
+
+		assert.Error(t, Merge(dst, narrow))
+		assert.Error(t, Merge(dst, other))
+		assert.Error(t, Merge(dst, dst))
+		assert.Error(t, Intersect(dst, narrow))
+		assert.NoError(t, Merge(narrow, dst))
+	})
+}
+
+// tempFilter returns a filter backed by a temporary file along with a
+// function that closes and removes it.
+func tempFilter(t *testing.T, bits uint, opts Options) (*casFilter, func()) {
+	fh, err := ioutil.TempFile("", "cascade")
+	assert.NoError(t, err)
+
+	cf, err := NewOptions(fh, bits, opts)
+	assert.NoError(t, err)
+
+	return cf, func() {
+		cf.Close()
+		fh.Close()
+		os.Remove(fh.Name())
+	}
+}
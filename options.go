@@ -0,0 +1,232 @@
+package cascade
+
+import (
+	"math"
+
+	"github.com/zeebo/errs"
+)
+
+// Options controls the behavior of a filter. The zero value is valid and
+// gives the defaults documented on each field.
+type Options struct {
+	// Background causes spills to happen in a background goroutine. Level 0
+	// is double buffered so that Add only blocks when both buffers are full.
+	Background bool
+
+	// Layout is how the slots of every level are stored. It is recorded in
+	// the file and only used by New.
+	Layout Layout
+
+	// Counting causes the filter to count the times a hash is added, so
+	// that Count reports it and Remove removes one of them. A hash added
+	// more than once is followed by counter slots holding its count in
+	// digits as wide as the remainder and value, and every slot has one
+	// more bit to mark them. It is recorded in the file and only used by
+	// New.
+	Counting bool
+
+	// ValueBits is the number of bits of the value stored with every hash
+	// by AddValue and returned by Get, which makes the filter an approximate
+	// map. It can be at most 32. If zero, no values are stored. It is
+	// recorded in the file and only used by New.
+	ValueBits uint
+
+	// FPR is the target false positive rate of level 0. It picks the
+	// remainder bits of level 0, which with the hash bits fixes its size,
+	// so it cannot be combined with Level0Bytes. It is only used by New.
+	FPR float64
+
+	// Level0Bytes is the largest size of level 0. The remainder bits are
+	// the fewest that fit. If zero and FPR is zero, 4096 is used. It is only
+	// used by New.
+	Level0Bytes int64
+
+	// LoadFactor is the fraction of level 0 that is filled before it is
+	// spilled. It must be in (0, 1). If zero, 0.75 is used.
+	LoadFactor float64
+
+	// Growth is the factor each level past the second grows by. It must be
+	// a power of two, and every level takes log2(Growth) bits from the
+	// remainder for the quotient. If zero, 2 is used.
+	Growth uint
+
+	// MinRemainder is the fewest remainder bits a level may have. Every level
+	// past the second has fewer remainder bits than the one before it, so
+	// this bounds the false positive rate of the deepest level and the number
+	// of levels. If zero, 5 is used.
+	MinRemainder uint
+
+	// HotBytes is the total size of the smallest levels that are kept hot.
+	// Hot levels are advised that they will be needed, so they are read
+	// ahead when mapped, and Warm faults them in. If zero, 64 KiB is used,
+	// and if negative, no level is hot.
+	HotBytes int64
+
+	// LockHot causes the hot levels to be locked in memory with mlock, which
+	// is limited by RLIMIT_MEMLOCK. Failing to lock them is only reported by
+	// Warm.
+	LockHot bool
+
+	// RandomBytes is the size at which a level that is not hot is advised
+	// that it is accessed randomly, which keeps faults from reading ahead.
+	// If zero, no level is.
+	RandomBytes int64
+
+	// SummaryBits is the number of bits per hash of the summary kept in
+	// memory for the deepest level. A lookup skips a level when its summary
+	// shows that the hash is absent, so a negative lookup rarely touches the
+	// pages of the levels past level 0. The levels above the deepest get more
+	// bits per hash, so that the chance of probing any level stays bounded
+	// however many levels there are. Summaries are built by spills, and in the
+	// background for the levels of an opened filter, which are probed until
+	// then. It can be at most 64. If zero, 3 is used, and if negative, levels
+	// have no summaries.
+	//
+	// With the default, a negative lookup probes under half of a level past
+	// level 0 on average, and the summaries take between 3 and 5 bits of
+	// memory per hash, which is up to about a fifth of the size of the levels
+	// for 32 bit hashes and less for wider ones.
+	SummaryBits int
+
+	// Hasher hashes keys for AddKey and LookupKey. Its ID and seed are
+	// recorded in the file, and a file written with a hasher other than the
+	// default can only be reopened by passing a hasher with the same ID and
+	// seed. If nil, NewHasher(0) is used, or the recorded seed on Open.
+	Hasher Hasher
+}
+
+func (o Options) level0Bytes() int64 {
+	if o.Level0Bytes == 0 {
+		return 4096
+	}
+	return o.Level0Bytes
+}
+
+func (o Options) loadFactor() float64 {
+	if o.LoadFactor == 0 {
+		return 0.75
+	}
+	return o.LoadFactor
+}
+
+// growthBits returns log2 of the growth factor.
+func (o Options) growthBits() uint {
+	if o.Growth == 0 {
+		return 1
+	}
+	bits := uint(0)
+	for g := o.Growth; g > 1; g >>= 1 {
+		bits++
+	}
+	return bits
+}
+
+func (o Options) hasher() Hasher {
+	if o.Hasher == nil {
+		return NewHasher(0)
+	}
+	return o.Hasher
+}
+
+func (o Options) hotBytes() int64 {
+	if o.HotBytes == 0 {
+		return 64 << 10
+	}
+	return o.HotBytes
+}
+
+func (o Options) summaryBits() int {
+	if o.SummaryBits == 0 {
+		return 3
+	}
+	return o.SummaryBits
+}
+
+func (o Options) minRemainder() uint {
+	if o.MinRemainder == 0 {
+		return 5
+	}
+	return o.MinRemainder
+}
+
+// validate returns an error if the options that apply to any filter are
+// impossible.
+func (o Options) validate() error {
+	switch {
+	case o.LoadFactor < 0 || o.LoadFactor >= 1 || math.IsNaN(o.LoadFactor):
+		return errs.New("invalid load factor: %v", o.LoadFactor)
+	case o.Growth == 1 || o.Growth&(o.Growth-1) != 0:
+		return errs.New("invalid growth factor: %d", o.Growth)
+	case o.minRemainder() >= 64:
+		return errs.New("invalid minimum remainder: %d", o.MinRemainder)
+	case o.Layout.validate() != nil:
+		return o.Layout.validate()
+	case o.ValueBits > maxValueBits:
+		return errs.New("invalid value bits: %d", o.ValueBits)
+	case o.RandomBytes < 0:
+		return errs.New("invalid random level size: %d", o.RandomBytes)
+	case o.SummaryBits > 64:
+		return errs.New("invalid summary bits: %d", o.SummaryBits)
+	}
+	return nil
+}
+
+// geometry returns the quotient and remainder bits of level 0 for a filter
+// with the given hash bits.
+func (o Options) geometry(bits uint) (q, r uint, err error) {
+	if err := o.validate(); err != nil {
+		return 0, 0, err
+	}
+
+	min := o.minRemainder()
+	switch {
+	case bits > 64:
+		return 0, 0, errs.New("invalid hash bits: %d", bits)
+	case bits <= min:
+		return 0, 0, errs.New("hash bits %d leave no room for a quotient with "+
+			"minimum remainder %d", bits, min)
+	case o.FPR != 0 && o.Level0Bytes != 0:
+		return 0, 0, errs.New("both target false positive rate and level 0 size specified")
+	case o.FPR < 0 || o.FPR >= 1 || math.IsNaN(o.FPR):
+		return 0, 0, errs.New("invalid false positive rate: %v", o.FPR)
+	case o.Level0Bytes < 0:
+		return 0, 0, errs.New("invalid level 0 size: %d", o.Level0Bytes)
+	}
+
+	if o.FPR != 0 {
+		// a full quotient filter has a false positive rate of about
+		// 2^-r times its load.
+		fr := math.Ceil(math.Log2(o.loadFactor() / o.FPR))
+		if fr >= float64(bits) {
+			return 0, 0, errs.New("false positive rate %v needs more than %d hash bits",
+				o.FPR, bits)
+		}
+		r = uint(math.Max(fr, float64(min)))
+		if err := o.checkWidth(r); err != nil {
+			return 0, 0, err
+		}
+		return bits - r, r, nil
+	}
+
+	// find the smallest r such that the level fits with r+q = bits.
+	size := o.level0Bytes()
+	for r := min; r < bits; r++ {
+		if o.Layout.bytes(bits-r, r, slotBits(o.ValueBits, o.Counting)) <= float64(size) {
+			if err := o.checkWidth(r); err != nil {
+				return 0, 0, err
+			}
+			return bits - r, r, nil
+		}
+	}
+	return 0, 0, errs.New("level 0 cannot fit in %d bytes with %d hash bits", size, bits)
+}
+
+// checkWidth returns an error if a remainder of r bits and a value do not
+// fit in a slot. level 0 has the most remainder bits, so it is the widest.
+func (o Options) checkWidth(r uint) error {
+	if r+slotBits(o.ValueBits, o.Counting) > maxSlotBits {
+		return errs.New("remainder bits %d with value bits %d do not fit in a slot",
+			r, o.ValueBits)
+	}
+	return nil
+}
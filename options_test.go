@@ -0,0 +1,106 @@
+package cascade
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/zeebo/assert"
+	"github.com/zeebo/errs"
+	"github.com/zeebo/pcg"
+)
+
+func TestOptions(t *testing.T) {
+	t.Run("Defaults", func(t *testing.T) {
+		q, r, err := Options{}.geometry(20)
+		assert.NoError(t, err)
+		assert.Equal(t, q, uint(11))
+		assert.Equal(t, r, uint(9))
+		assert.That(t, bufSize(q, r) <= 4096)
+	})
+
+	t.Run("Level0Bytes", func(t *testing.T) {
+		for _, size := range []int64{1024, 4096, 1 << 20} {
+			q, r, err := Options{Level0Bytes: size}.geometry(40)
+			assert.NoError(t, err)
+			assert.That(t, int64(bufSize(q, r)) <= size)
+			assert.That(t, int64(bufSize(q+1, r-1)) > size)
+		}
+	})
+
+	t.Run("FPR", func(t *testing.T) {
+		q, r, err := Options{FPR: 0.01}.geometry(40)
+		assert.NoError(t, err)
+		assert.Equal(t, r, uint(7)) // 0.75 * 2^-7 < 0.01
+		assert.Equal(t, q, uint(33))
+
+		// a loose rate is still limited by the minimum remainder
+		_, r, err = Options{FPR: 0.5}.geometry(40)
+		assert.NoError(t, err)
+		assert.Equal(t, r, uint(5))
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, c := range []struct {
+			bits uint
+			opts Options
+		}{
+			{20, Options{LoadFactor: 1}},
+			{20, Options{LoadFactor: -0.5}},
+			{20, Options{Growth: 1}},
+			{20, Options{Growth: 3}},
+			{20, Options{MinRemainder: 64}},
+			{20, Options{FPR: 0.01, Level0Bytes: 4096}},
+			{20, Options{FPR: 1}},
+			{20, Options{FPR: 1e-9}},
+			{20, Options{Level0Bytes: -1}},
+			{20, Options{Level0Bytes: 1}},
+			{5, Options{}},
+			{65, Options{}},
+			{20, Options{ValueBits: 33}},
+			{60, Options{ValueBits: 32}},
+			{20, Options{RandomBytes: -1}},
+			{20, Options{SummaryBits: 65}},
+		} {
+			_, _, err := c.opts.geometry(c.bits)
+			assert.Error(t, err)
+		}
+	})
+
+	t.Run("Growth", func(t *testing.T) {
+		for _, growth := range []uint{2, 4, 8} {
+			fh, err := ioutil.TempFile("", "cascade")
+			assert.NoError(t, err)
+			defer os.Remove(fh.Name())
+			defer fh.Close()
+
+			opts := Options{Growth: growth, LoadFactor: 0.5}
+			cf, err := NewOptions(fh, 24, opts)
+			assert.NoError(t, err)
+
+			n := 0
+			for ; ; n++ {
+				if err := cf.Add(pcg.Uint64()); err != nil {
+					assert.Equal(t, errs.Unwrap(err), ErrFull)
+					break
+				}
+			}
+
+			shift := opts.growthBits()
+			for i, l := range cf.levels[2:] {
+				assert.Equal(t, l.QuotientBits(), cf.levels[i+1].QuotientBits()+shift)
+			}
+
+			// no level is past the load factor, and the deepest level is
+			// filled to at least half of it before the filter is full, so a
+			// larger growth does not leave the deepest level unused.
+			for _, l := range cf.levels {
+				assert.That(t, l.Len() <= l.Cap()/2)
+			}
+			deepest := cf.levels[len(cf.levels)-1]
+			assert.That(t, deepest.Len() >= deepest.Cap()/4)
+			assert.That(t, uint(n) >= deepest.Cap()/4)
+			assert.NoError(t, cf.Close())
+		}
+	})
+}
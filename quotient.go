@@ -8,25 +8,38 @@ type ( // helpers to keep things straight
 
 type quoFil struct {
 	br   bitReader
-	q, r uint  // quotient and remainder bits
-	mask index // 1 << q - 1
-	len  uint
+	q, r uint      // quotient and remainder bits
+	v    uint      // value bits, stored above the remainder
+	mask index     // 1 << q - 1
+	len  uint      // slots in use
+	flag remainder // marks the counter slots if the filter is counting
 }
 
 func bufSize(q, r uint) uint { return ((1<<q)*(3+r) + 7) / 8 }
 
-func newQuoFil(q, r uint, buf []byte) *quoFil {
+func newQuoFil(q, r, v uint, buf []byte) *quoFil {
 	if buf == nil {
-		buf = make([]byte, bufSize(q, r))
+		buf = make([]byte, bufSize(q, r+v))
 	}
 	return &quoFil{
-		br:   newBitReader(buf, 3+r),
+		br:   newBitReader(buf, 3+r+v),
 		q:    q,
 		r:    r,
+		v:    v,
 		mask: 1<<q - 1,
 	}
 }
 
+// newCountingQuoFil is like newQuoFil but for a counting filter. A hash added
+// n times is stored in its slot followed by counter slots holding n-1 in
+// digits of r+v bits, least significant first. Every slot has a bit above the
+// value that marks the counter slots.
+func newCountingQuoFil(q, r, v uint, buf []byte) *quoFil {
+	f := newQuoFil(q, r, v+1, buf)
+	f.v, f.flag = v, 1<<(r+v)
+	return f
+}
+
 func (q *quoFil) Empty() bool         { return q.len == 0 }
 func (q *quoFil) Len() uint           { return q.len }
 func (q *quoFil) Cap() uint           { return 1 << q.q }
@@ -34,6 +47,9 @@ func (q *quoFil) Bits() uint          { return q.q + q.r }
 func (q *quoFil) QuotientBits() uint  { return q.q }
 func (q *quoFil) RemainderBits() uint { return q.r }
 
+func (q *quoFil) buffer() []byte { return q.br.buf }
+func (q *quoFil) setLen(n uint)  { q.len = n }
+
 func (q *quoFil) Clear() {
 	q.len = 0
 	for i := range q.br.buf {
@@ -41,12 +57,29 @@ func (q *quoFil) Clear() {
 	}
 }
 
+// count returns the number of slots in use by scanning every slot. It is used
+// to recover the length when the buffer was filled by some other quoFil.
+func (q *quoFil) count() (n uint) {
+	for idx := index(0); idx <= q.mask; idx++ {
+		if !q.getSlot(idx).Empty() {
+			n++
+		}
+	}
+	return n
+}
+
 func (q *quoFil) getSlot(idx index) slot     { return slot(q.br.Get(uint(idx))) }
 func (q *quoFil) setSlot(idx index, sl slot) { q.br.Put(uint(idx), uint64(sl)) }
 
 func (q *quoFil) quotient(hash uint64) quotient   { return quotient(hash >> q.r) }
 func (q *quoFil) remainder(hash uint64) remainder { return remainder(hash & (1<<q.r - 1)) }
 
+// the remainder field of a slot holds the value above the remainder.
+func (q *quoFil) pack(rem remainder, value uint64) remainder { return rem | remainder(value)<<q.r }
+func (q *quoFil) slotRemainder(s slot) remainder             { return s.Remainder() & (1<<q.r - 1) }
+func (q *quoFil) slotValue(s slot) uint64                    { return uint64(s.Remainder()&^q.flag) >> q.r }
+func (q *quoFil) counter(s slot) bool                        { return s.Remainder()&q.flag != 0 }
+
 func (q *quoFil) index(quo quotient) index { return index(quo) & q.mask }
 func (q *quoFil) next(idx index) index     { return (idx + 1) & q.mask }
 func (q *quoFil) prev(idx index) index     { return (idx - 1) & q.mask }
@@ -98,46 +131,100 @@ func (q *quoFil) insertSlot(idx index, s slot) {
 	}
 }
 
-func (q *quoFil) Lookup(hash uint64) bool {
+// find returns the slot holding the hash.
+func (q *quoFil) find(hash uint64) (index, bool) {
 	quo := q.quotient(hash)
 	rem := q.remainder(hash)
 	idx := q.index(quo)
 
 	if !q.getSlot(idx).Occupied() {
-		return false
+		return 0, false
 	}
 
 	run := q.findRun(idx)
 	slot := q.getSlot(run)
 
 	for {
-		if srem := slot.Remainder(); srem == rem {
-			return true
-		} else if srem > rem {
-			return false
+		// counter slots hold the count of an earlier remainder in the run.
+		if !q.counter(slot) {
+			if srem := q.slotRemainder(slot); srem == rem {
+				return run, true
+			} else if srem > rem {
+				return 0, false
+			}
 		}
 
 		run = q.next(run)
 		slot = q.getSlot(run)
 
 		if !slot.Continuation() {
-			return false
+			return 0, false
+		}
+	}
+}
+
+func (q *quoFil) Lookup(hash uint64) bool {
+	_, ok := q.find(hash)
+	return ok
+}
+
+// Get returns the value stored with the hash.
+func (q *quoFil) Get(hash uint64) (uint64, bool) {
+	idx, ok := q.find(hash)
+	if !ok {
+		return 0, false
+	}
+	return q.slotValue(q.getSlot(idx)), true
+}
+
+func (q *quoFil) Add(hash uint64) bool { return q.AddValue(hash, 0) }
+
+func (q *quoFil) AddValue(hash, value uint64) bool { return q.AddCount(hash, value, 1) }
+
+// AddCount adds the hash to the filter n times with the value, replacing the
+// value if the hash is already present. If the filter is not counting, it is
+// added once. It reports false without changing the filter if there is no
+// room for it.
+func (q *quoFil) AddCount(hash, value, n uint64) bool {
+	qidx := q.index(q.quotient(hash))
+	rem := q.pack(q.remainder(hash), value)
+
+	if idx, ok := q.find(hash); ok {
+		if q.flag != 0 {
+			extra, k := q.extra(idx)
+			if !q.setExtra(qidx, idx, k, extra+n) {
+				return false
+			}
 		}
+		q.setSlot(idx, q.getSlot(idx).SetRemainder(rem))
+		return true
+	}
+
+	extra := uint64(0)
+	if q.flag != 0 {
+		extra = n - 1
 	}
+	if q.len+1+counterSlots(extra, q.r+q.v) > q.Cap() {
+		return false
+	}
+	q.setExtra(qidx, q.insert(hash, value), 0, extra)
+	return true
 }
 
-func (q *quoFil) Add(hash uint64) {
+// insert puts a slot for the hash, which must not be present, in its sorted
+// place in the run for its quotient and returns where it went.
+func (q *quoFil) insert(hash, value uint64) index {
 	quo := q.quotient(hash)
 	rem := q.remainder(hash)
 	qidx := q.index(quo)
 
 	qslot := q.getSlot(qidx)
-	nslot := newSlot(rem)
+	nslot := newSlot(q.pack(rem, value))
 
 	if qslot.Empty() {
 		q.setSlot(qidx, nslot.SetOccupied())
 		q.len++
-		return
+		return qidx
 	}
 
 	if !qslot.Occupied() {
@@ -151,9 +238,7 @@ func (q *quoFil) Add(hash uint64) {
 		rslot := q.getSlot(ridx)
 
 		for {
-			if srem := rslot.Remainder(); srem == rem {
-				return
-			} else if srem > rem {
+			if !q.counter(rslot) && q.slotRemainder(rslot) > rem {
 				break
 			}
 
@@ -178,50 +263,310 @@ func (q *quoFil) Add(hash uint64) {
 	}
 	q.insertSlot(ridx, nslot)
 	q.len++
+	return ridx
+}
+
+// extra returns the count held by the counter slots after the slot at idx
+// and how many of them there are.
+func (q *quoFil) extra(idx index) (n uint64, k uint) {
+	if q.flag == 0 {
+		return 0, 0
+	}
+	for {
+		idx = q.next(idx)
+		s := q.getSlot(idx)
+		if !s.Continuation() || !q.counter(s) {
+			return n, k
+		}
+		n |= uint64(s.Remainder()&^q.flag) << (k * (q.r + q.v))
+		k++
+	}
+}
+
+// setExtra stores n in the k counter slots after the slot at idx in the run
+// for the quotient at qidx, inserting or removing counter slots as needed. It
+// reports false without changing the filter if there is no room.
+func (q *quoFil) setExtra(qidx, idx index, k uint, n uint64) bool {
+	d := q.r + q.v
+	need := counterSlots(n, d)
+	if need > k && q.len+need-k > q.Cap() {
+		return false
+	}
+
+	for i := uint(0); i < need; i++ {
+		pos := (idx + index(i) + 1) & q.mask
+		digit := q.flag | remainder(counterDigit(n, d, i))
+		if i < k {
+			q.setSlot(pos, q.getSlot(pos).SetRemainder(digit))
+			continue
+		}
+		// a counter slot is never the start of a run.
+		q.insertSlot(pos, newSlot(digit).SetContinuation().SetShifted())
+		q.len++
+	}
+	for i := need; i < k; i++ {
+		q.removeSlot(qidx, (idx+index(need)+1)&q.mask)
+	}
+	return true
+}
+
+// Count returns the number of times the hash was added, which is at most one
+// unless the filter is counting.
+func (q *quoFil) Count(hash uint64) uint64 {
+	idx, ok := q.find(hash)
+	if !ok {
+		return 0
+	}
+	n, _ := q.extra(idx)
+	return n + 1
+}
+
+// Remove removes the hash from the filter, reporting if it was present. If
+// the filter is counting, it removes one of the times it was added.
+func (q *quoFil) Remove(hash uint64) bool {
+	idx, ok := q.find(hash)
+	if !ok {
+		return false
+	}
+
+	qidx := q.index(q.quotient(hash))
+	if n, k := q.extra(idx); n > 0 {
+		return q.setExtra(qidx, idx, k, n-1)
+	}
+	q.removeSlot(qidx, idx)
+	return true
+}
+
+// removeSlot removes the slot at pos from the run for the quotient at qidx.
+// Any elements shifted past it in its cluster are shifted back.
+func (q *quoFil) removeSlot(qidx, pos index) {
+	run := q.findRun(qidx)
+
+	// if it was the only element in the run, the quotient is now unoccupied.
+	if pos == run && !q.getSlot(q.next(pos)).Continuation() {
+		q.setSlot(qidx, q.getSlot(qidx).ClearOccupied())
+	}
+
+	// shift the rest of the cluster back into the hole. cur tracks the
+	// quotient of the run the moved element belongs to so that we know
+	// if it ends up back in its canonical slot.
+	cur, hole := qidx, pos
+	for first := true; ; first = false {
+		nidx := q.next(hole)
+		nslot := q.getSlot(nidx)
+		occupied := q.getSlot(hole).Occupied()
+
+		var moved slot
+		if nslot.Empty() || !nslot.Shifted() {
+			if occupied {
+				moved = moved.SetOccupied()
+			}
+			q.setSlot(hole, moved)
+			break
+		}
+
+		moved = newSlot(nslot.Remainder())
+		if occupied {
+			moved = moved.SetOccupied()
+		}
+
+		switch {
+		case nslot.Continuation() && !(first && pos == run):
+			moved = moved.SetContinuation().SetShifted()
+
+		default:
+			// the element starts a run, either because it was already the
+			// start of the next quotient's run or because we removed the
+			// start of its run.
+			if !nslot.Continuation() {
+				cur = q.next(cur)
+				for !q.getSlot(cur).Occupied() {
+					cur = q.next(cur)
+				}
+			}
+			if hole != cur {
+				moved = moved.SetShifted()
+			}
+		}
+
+		q.setSlot(hole, moved)
+		hole = nidx
+	}
+
+	q.len--
 }
 
 //
 // iterator
 //
 
+// quoFilIter walks the hashes in sorted order. Rather than walking the slots,
+// it walks the occupied quotients and the runs for them so that a cluster that
+// wraps around the end of the table does not put its hashes out of order.
 type quoFilIter struct {
-	q    *quoFil
-	idx  index
-	quo  quotient
-	vis  uint
-	hash uint64
+	q     *quoFil
+	quo   index // quotient of the current run
+	pos   index // slot of the next hash, not reduced by the mask
+	done  bool
+	hash  uint64
+	value uint64
+	count uint64
 }
 
-func (q *quoFil) Iter() (it quoFilIter) {
-	it.q = q
-	for q.len > 0 && !q.getSlot(it.idx).ClusterStart() {
-		it.idx = q.next(it.idx)
-	}
+func (q *quoFil) Iter() iterator {
+	it := &quoFilIter{q: q}
+	it.Seek(0)
 	return it
 }
 
+// Seek moves the iterator so that Next yields the hashes at least hash. It
+// starts at the run for the first occupied quotient at least the quotient of
+// the hash and skips the smaller remainders in it.
+func (it *quoFilIter) Seek(hash uint64) {
+	q := it.q
+	hash &= 1<<q.Bits() - 1
+
+	it.quo, it.done = q.index(q.quotient(hash)), q.len == 0
+	if it.done || !it.nextRun() {
+		return
+	}
+
+	// a run for a quotient at the end of the table may wrap around to the
+	// start, so it is past the quotient once the mask is removed.
+	it.pos = q.findRun(it.quo)
+	if it.pos < it.quo {
+		it.pos += q.mask + 1
+	}
+
+	for !it.done && it.peek() < hash {
+		it.advance()
+	}
+}
+
+// nextRun moves the quotient to the first occupied one at least it, marking
+// the iterator done if there is none.
+func (it *quoFilIter) nextRun() bool {
+	for it.quo <= it.q.mask && !it.q.getSlot(it.quo).Occupied() {
+		it.quo++
+	}
+	it.done = it.quo > it.q.mask
+	return !it.done
+}
+
+// peek returns the hash in the next slot.
+func (it *quoFilIter) peek() uint64 {
+	s := it.q.getSlot(it.pos & it.q.mask)
+	return uint64(it.quo)<<it.q.r | uint64(it.q.slotRemainder(s))
+}
+
+// advance moves past the next slot and its counter slots. if the run is
+// over, it moves to the run for the next occupied quotient, which starts either
+// right after this one or in its canonical slot.
+func (it *quoFilIter) advance() {
+	_, k := it.q.extra(it.pos & it.q.mask)
+	it.pos += index(k) + 1
+	if it.q.getSlot(it.pos & it.q.mask).Continuation() {
+		return
+	}
+	it.quo++
+	if it.nextRun() && it.pos < it.quo {
+		it.pos = it.quo
+	}
+}
+
 func (it *quoFilIter) Next() bool {
-	if it.vis >= it.q.len {
+	if it.done {
 		return false
 	}
-	for {
-		s := it.q.getSlot(it.idx)
-		if s.ClusterStart() {
-			it.quo = quotient(it.idx)
-		} else if s.RunStart() {
-			quo := it.q.next(it.q.index(it.quo))
-			for !it.q.getSlot(quo).Occupied() {
-				quo = it.q.next(quo)
-			}
-			it.quo = quotient(quo)
+
+	s := it.q.getSlot(it.pos & it.q.mask)
+	it.hash = uint64(it.quo)<<it.q.r | uint64(it.q.slotRemainder(s))
+	it.value = it.q.slotValue(s)
+	extra, _ := it.q.extra(it.pos & it.q.mask)
+	it.count = extra + 1
+	it.advance()
+
+	return true
+}
+
+func (it *quoFilIter) Hash() uint64  { return it.hash }
+func (it *quoFilIter) Value() uint64 { return it.value }
+func (it *quoFilIter) Count() uint64 { return it.count }
+
+//
+// builder
+//
+
+// quoFilBuilder fills an empty quoFil from hashes given in sorted order
+// with sequential writes instead of the shifting that Add does.
+type quoFilBuilder struct {
+	q    *quoFil
+	quo  index // quotient of the current run
+	pos  index // slot for the next hash, not reduced by the mask
+	last uint64
+}
+
+func (q *quoFil) builder() builder {
+	return &quoFilBuilder{q: q}
+}
+
+// Add inserts the hash n times with the value. The hash must be larger than
+// any previously added.
+func (b *quoFilBuilder) Add(hash, value, n uint64) bool {
+	q := b.q
+	hash &= 1<<q.Bits() - 1
+
+	if q.len > 0 && hash <= b.last {
+		return true
+	}
+	b.last = hash
+
+	extra := uint64(0)
+	if q.flag != 0 {
+		extra = n - 1
+	}
+	k := index(counterSlots(extra, q.r+q.v))
+
+	// once a run wraps around the end of the table it would collide with
+	// the clusters at the start, so fall back to shifting them forward.
+	if b.pos > q.mask {
+		return q.AddCount(hash, value, n)
+	}
+
+	quo := q.index(q.quotient(hash))
+	nslot := newSlot(q.pack(q.remainder(hash), value))
+
+	pos, run := b.pos, q.len > 0 && quo == b.quo
+	if !run && pos < quo {
+		pos = quo
+	}
+	if pos+k > q.mask {
+		b.pos = pos + k
+		return q.AddCount(hash, value, n)
+	}
+
+	if run {
+		nslot = nslot.SetContinuation().SetShifted()
+	} else {
+		q.setSlot(quo, q.getSlot(quo).SetOccupied())
+		if pos != quo {
+			nslot = nslot.SetShifted()
 		}
-		it.idx = it.q.next(it.idx)
-		if !s.Empty() {
-			it.hash = uint64(it.quo)<<it.q.r | uint64(s.Remainder())
-			it.vis++
-			return true
+		b.quo = quo
+	}
+
+	// the counter slots follow the slot for the hash in the run.
+	for i := index(0); i <= k; i++ {
+		if i > 0 {
+			digit := counterDigit(extra, q.r+q.v, uint(i-1))
+			nslot = newSlot(q.flag | remainder(digit)).SetContinuation().SetShifted()
+		}
+		if q.getSlot(pos + i).Occupied() {
+			nslot = nslot.SetOccupied()
 		}
+		q.setSlot(pos+i, nslot)
 	}
+	q.len += uint(k) + 1
+	b.pos = pos + k + 1
+	return true
 }
-
-func (it *quoFilIter) Hash() uint64 { return it.hash }
@@ -9,7 +9,7 @@ import (
 
 func TestQuotient(t *testing.T) {
 	t.Run("Basic", func(t *testing.T) {
-		q := newQuoFil(10, 5, nil)
+		q := newQuoFil(10, 5, 0, nil)
 		var e []uint64
 
 		for i := 0; i < 500; i++ {
@@ -24,7 +24,7 @@ func TestQuotient(t *testing.T) {
 	})
 
 	t.Run("False Positive", func(t *testing.T) {
-		q := newQuoFil(10, 5, nil)
+		q := newQuoFil(10, 5, 0, nil)
 
 		for i := 0; i < 750; i++ {
 			q.Add(pcg.Uint64())
@@ -41,7 +41,7 @@ func TestQuotient(t *testing.T) {
 	})
 
 	t.Run("Bug 0", func(t *testing.T) {
-		q := newQuoFil(5, 3, nil)
+		q := newQuoFil(5, 3, 0, nil)
 		q.Add(0x12)
 		q.Add(0x14)
 		q.Add(0x17)
@@ -56,7 +56,7 @@ func TestQuotient(t *testing.T) {
 	})
 
 	t.Run("Iterator", func(t *testing.T) {
-		q := newQuoFil(10, 5, nil)
+		q := newQuoFil(10, 5, 0, nil)
 		e := make(map[uint64]bool)
 
 		for i := 0; i < 500; i++ {
@@ -80,11 +80,234 @@ func TestQuotient(t *testing.T) {
 
 		assert.Equal(t, len(e), 0)
 	})
+
+	t.Run("Remove", func(t *testing.T) {
+		for _, size := range []int{100, 500, 900} {
+			q := newQuoFil(10, 5, 0, nil)
+			e := make(map[uint64]bool)
+
+			for len(e) < size {
+				x := pcg.Uint64() & (1<<15 - 1)
+				if !e[x] {
+					e[x] = true
+					q.Add(x)
+				}
+			}
+
+			for x := range e {
+				assert.That(t, q.Remove(x))
+				assert.That(t, !q.Remove(x))
+				assert.That(t, !q.Lookup(x))
+				delete(e, x)
+
+				if len(e)%50 == 0 {
+					assert.Equal(t, q.Len(), uint(len(e)))
+					assert.Equal(t, q.count(), uint(len(e)))
+					for v := range e {
+						assert.That(t, q.Lookup(v))
+					}
+					for it := q.Iter(); it.Next(); {
+						assert.That(t, e[it.Hash()])
+					}
+				}
+			}
+
+			for _, b := range q.br.buf {
+				assert.Equal(t, b, byte(0))
+			}
+		}
+	})
+
+	t.Run("Sorted", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			q := newQuoFil(6, 4, 0, nil)
+			for q.Len() < 60 {
+				q.Add(pcg.Uint64())
+			}
+
+			n, last := uint(0), uint64(0)
+			for it := q.Iter(); it.Next(); n++ {
+				assert.That(t, n == 0 || it.Hash() > last)
+				last = it.Hash()
+			}
+			assert.Equal(t, n, q.Len())
+		}
+	})
+
+	t.Run("Builder", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			q := newQuoFil(6, 4, 0, nil)
+			for q.Len() < 60 {
+				q.Add(pcg.Uint64())
+			}
+
+			q2 := newQuoFil(6, 4, 0, nil)
+			b := q2.builder()
+			for it := q.Iter(); it.Next(); {
+				b.Add(it.Hash(), it.Value(), it.Count())
+			}
+
+			assert.Equal(t, q2.Len(), q.Len())
+			assert.DeepEqual(t, q2.br.buf, q.br.buf)
+		}
+	})
+
+	t.Run("Counting", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			q := newCountingQuoFil(6, 4, 0, nil)
+
+			// counts past 16 take a second counter slot.
+			counts := make(map[uint64]uint64)
+			for q.Len() < 60 {
+				x := pcg.Uint64() & 0x3ff
+				for n := pcg.Uint32n(40) + 1; n > 0 && q.Len() < 60; n-- {
+					assert.That(t, q.Add(x))
+					counts[x]++
+				}
+			}
+			for x, n := range counts {
+				assert.Equal(t, q.Count(x), n)
+			}
+			assert.Equal(t, q.count(), q.Len())
+
+			// the iterator yields every hash once with its count, and the
+			// builder keeps them.
+			q2 := newCountingQuoFil(6, 4, 0, nil)
+			b := q2.builder()
+			for it := q.Iter(); it.Next(); {
+				assert.Equal(t, it.Count(), counts[it.Hash()])
+				b.Add(it.Hash(), it.Value(), it.Count())
+			}
+			assert.Equal(t, q2.Len(), q.Len())
+			assert.DeepEqual(t, q2.br.buf, q.br.buf)
+
+			// removing takes away a single copy.
+			for x, n := range counts {
+				assert.That(t, q.Remove(x))
+				assert.Equal(t, q.Count(x), n-1)
+				assert.Equal(t, q.Lookup(x), n > 1)
+			}
+		}
+	})
+
+	t.Run("Counting Hot", func(t *testing.T) {
+		q := newCountingQuoFil(6, 4, 0, nil)
+		for x := uint64(0); x < 40; x++ {
+			assert.That(t, q.Add(x*25))
+		}
+
+		// a hash added many times only takes a few counter slots, and once
+		// there is no room, adding fails without changing the filter.
+		const hot = 0x155
+		for i := 0; i < 100000; i++ {
+			assert.That(t, q.Add(hot))
+		}
+		assert.Equal(t, q.Count(hot), uint64(100000))
+		assert.Equal(t, q.Len(), uint(40+1+5))
+		assert.Equal(t, q.count(), q.Len())
+
+		for x := uint64(0); q.Len() < q.Cap(); x++ {
+			if x != hot && !q.Lookup(x) {
+				assert.That(t, q.Add(x))
+			}
+		}
+		buf := append([]byte(nil), q.br.buf...)
+		for x := uint64(0); x < 1<<10; x++ {
+			if !q.Lookup(x) {
+				assert.That(t, !q.Add(x))
+			}
+		}
+		assert.That(t, !q.AddCount(hot, 0, 1<<20))
+		assert.DeepEqual(t, q.br.buf, buf)
+		assert.Equal(t, q.Count(hot), uint64(100000))
+
+		for i := 0; i < 100000; i++ {
+			assert.That(t, q.Remove(hot))
+		}
+		assert.That(t, !q.Lookup(hot))
+		assert.Equal(t, q.Len(), q.Cap()-6)
+	})
+
+	t.Run("Values", func(t *testing.T) {
+		q := newQuoFil(10, 5, 12, nil)
+		e := make(map[uint64]uint64)
+
+		for len(e) < 900 {
+			x := pcg.Uint64() & (1<<15 - 1)
+			v := pcg.Uint64() & (1<<12 - 1)
+			assert.That(t, q.AddValue(x, v))
+			e[x] = v
+		}
+		for x, v := range e {
+			got, ok := q.Get(x)
+			assert.That(t, ok)
+			assert.Equal(t, got, v)
+		}
+
+		// the iterator yields the values, and the builder keeps them.
+		q2 := newQuoFil(10, 5, 12, nil)
+		b := q2.builder()
+		for it := q.Iter(); it.Next(); {
+			assert.Equal(t, it.Value(), e[it.Hash()])
+			b.Add(it.Hash(), it.Value(), it.Count())
+		}
+		assert.DeepEqual(t, q2.br.buf, q.br.buf)
+
+		// adding again replaces the value, and removing shifts the values
+		// along with the remainders.
+		n := 0
+		for x := range e {
+			if n++; n%2 == 0 {
+				assert.That(t, q.Remove(x))
+				delete(e, x)
+			} else {
+				assert.That(t, q.AddValue(x, e[x]^1))
+				e[x] ^= 1
+			}
+		}
+		assert.Equal(t, q.Len(), uint(len(e)))
+		for x, v := range e {
+			got, ok := q.Get(x)
+			assert.That(t, ok)
+			assert.Equal(t, got, v)
+		}
+	})
+
+	t.Run("Seek", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			// a small, nearly full table so that clusters wrap around.
+			q := newQuoFil(6, 4, 0, nil)
+			for q.Len() < 60 {
+				q.Add(pcg.Uint64())
+			}
+
+			var all []uint64
+			for it := q.Iter(); it.Next(); {
+				all = append(all, it.Hash())
+			}
+
+			it := q.Iter()
+			for j := 0; j < 20; j++ {
+				target := pcg.Uint64() & (1<<10 - 1)
+				it.Seek(target)
+
+				rest := all
+				for len(rest) > 0 && rest[0] < target {
+					rest = rest[1:]
+				}
+				for _, x := range rest {
+					assert.That(t, it.Next())
+					assert.Equal(t, it.Hash(), x)
+				}
+				assert.That(t, !it.Next())
+			}
+		}
+	})
 }
 
 func BenchmarkQuotient(b *testing.B) {
 	b.Run("Add", func(b *testing.B) {
-		q := newQuoFil(11, 5, nil)
+		q := newQuoFil(11, 5, 0, nil)
 		b.ReportAllocs()
 		b.ResetTimer()
 
@@ -93,13 +316,13 @@ func BenchmarkQuotient(b *testing.B) {
 
 			// this causes a small amount of allocs, but whatever
 			if (i+1)%1024 == 0 {
-				q = newQuoFil(11, 5, nil)
+				q = newQuoFil(11, 5, 0, nil)
 			}
 		}
 	})
 
 	b.Run("Lookup Full", func(b *testing.B) {
-		q := newQuoFil(10, 5, nil)
+		q := newQuoFil(10, 5, 0, nil)
 		for i := 0; i < 750; i++ {
 			q.Add(pcg.Uint64())
 		}
@@ -1,7 +1,6 @@
 package cascade
 
 import (
-	"fmt"
 	"math/bits"
 	"unsafe"
 )
@@ -14,12 +13,24 @@ import (
 // | 64 bits runends  |
 // | r bit remainders | * 64
 //
+// if the filter stores values, each remainder has the value above it, so the
+// remainders are r+v bits instead. if the filter is counting, there is one more
+// bit above that marking the counter slots, which follow the remainder of a
+// hash added more than once in its run.
+//
 // offsets store how far to go from the quotient to the end of the run for that
 // quotient. it assumes that runs are typically short, and with high probability
 // offsets are never more than O(q). since we allow offsets to go up to 256 before
 // we error, there should be no problem unless an uneven distribution of hashes
 // is added.
 //
+// precisely, the offset for the block starting at quotient b is the distance
+// from b to the end of the run for the largest occupied quotient at most b. if
+// that run ends before b, the offset is zero, and it is distinguished from a run
+// ending at b by the runends bit for b being clear. runs are kept in quotient
+// order, and remainders within a run are kept sorted. runs do not wrap around,
+// so the buffer has some extra blocks past the last quotient.
+//
 
 type rsqfData struct {
 	buf     []byte // backing array
@@ -27,17 +38,31 @@ type rsqfData struct {
 	quoMask uint64 // mask for quotient
 	rem     uint   // bits per remainder
 	remMask uint64 // mask for remainder
-	block   uint64 // size of a block. 17 + 8*rem
+	val     uint   // bits per value
+	block   uint64 // size of a block. 17 + 8*(rem+val), and 8 more if counting
+	flag    uint64 // marks the counter slots if the filter is counting
+}
+
+// rsqfExtra is the number of blocks past the last quotient that runs can be
+// shifted into. the offset of the first of them bounds how far past it the
+// runs can end.
+const rsqfExtra = 5
+
+// rsqfSize returns the size of the buffer needed for the given bits per
+// quotient and remainder.
+func rsqfSize(quo, rem uint) uint64 {
+	return ((1<<quo+63)/64 + rsqfExtra) * (17 + 8*uint64(rem))
 }
 
-func newRSQFData(buf []byte, quo, rem uint) *rsqfData {
+func newRSQFData(buf []byte, quo, rem, val uint) *rsqfData {
 	return &rsqfData{
 		buf:     buf,
 		quo:     quo,
 		quoMask: 1<<quo - 1,
 		rem:     rem,
 		remMask: 1<<rem - 1,
-		block:   17 + 8*uint64(rem),
+		val:     val,
+		block:   17 + 8*uint64(rem+val),
 	}
 }
 
@@ -62,15 +87,18 @@ func (r *rsqfData) Runends(i uint64) *u64 {
 }
 
 // Remainders returns a bit reader for the ith remainders vector, which contains the
-// remainders for the slots in [64 * i, 64 * i + 64).
+// remainders and values for the slots in [64 * i, 64 * i + 64).
 func (r *rsqfData) Remainders(i uint64) bitReader {
-	off := r.block*i + 17
-	return newBitReader(r.buf[off:off+uint64(r.rem)*8], r.rem)
+	off, width := r.block*i+17, (r.block-17)/8
+	return newBitReader(r.buf[off:off+width*8], uint(width))
 }
 
 // Rank returns the number of set bits of the occupied bit vector starting at the
 // sth bit and stopping at the (s+b)th bit. b is at most 64.
 func (r *rsqfData) OccupiedRank(s, b uint64) uint {
+	if b == 0 {
+		return 0
+	}
 	idx, off := s/64, s%64
 
 	// we remove off lower order bits and keep at most b higher order bits.
@@ -86,14 +114,12 @@ func (r *rsqfData) OccupiedRank(s, b uint64) uint {
 		rank += uint(bits.OnesCount64(occ))
 	}
 
-	fmt.Printf("--- rank from bit %d for %d bits: %d\n", s, b, rank)
 	return rank
 }
 
 // SelectRunends returns the number of bits past s until the bth bit is set.
 func (r *rsqfData) RunendsSelect(s, b uint64) uint {
 	idx, off, acc := s/64, uint(s%64), uint(0)
-	fmt.Printf("--- selecting after bit %d for %d bits: ", s, b)
 
 check:
 	run := r.Runends(idx).toUint64()
@@ -129,27 +155,115 @@ check:
 		run &= run - 1
 	}
 
-	fmt.Println(acc + uint(bits.TrailingZeros64(run)))
 	return acc + uint(bits.TrailingZeros64(run))
 }
 
-// QuotientSlot returns the furthest slot that ends a run for some
-// quotient in [q / 64 * 64, q].
-func (r *rsqfData) QuotientSlot(q uint64) uint64 {
-	rep := q / 64 * 64
+// slots returns the number of slots in the buffer.
+func (r *rsqfData) slots() uint64 { return uint64(len(r.buf)) / r.block * 64 }
+
+func (r *rsqfData) occupied(quo uint64) bool {
+	return r.Occupied(quo/64).toUint64()&(1<<(quo%64)) != 0
+}
+
+func (r *rsqfData) setOccupied(quo uint64, v bool) {
+	occ := r.Occupied(quo / 64)
+	*occ = toU64(setBit(occ.toUint64(), quo%64, v))
+}
+
+func (r *rsqfData) runend(slot uint64) bool {
+	return r.Runends(slot/64).toUint64()&(1<<(slot%64)) != 0
+}
+
+func (r *rsqfData) setRunend(slot uint64, v bool) {
+	ends := r.Runends(slot / 64)
+	*ends = toU64(setBit(ends.toUint64(), slot%64, v))
+}
+
+// entry returns the remainder of the slot with its value above it.
+func (r *rsqfData) entry(slot uint64) uint64 {
+	rems := r.Remainders(slot / 64)
+	return rems.Get(uint(slot % 64))
+}
+
+func (r *rsqfData) setEntry(slot, entry uint64) {
+	rems := r.Remainders(slot / 64)
+	rems.Put(uint(slot%64), entry)
+}
+
+func (r *rsqfData) remainder(slot uint64) uint64 { return r.entry(slot) & r.remMask }
+func (r *rsqfData) value(slot uint64) uint64     { return r.entry(slot) &^ r.flag >> r.rem }
+func (r *rsqfData) counter(slot uint64) bool     { return r.entry(slot)&r.flag != 0 }
+
+func setBit(x, bit uint64, v bool) uint64 {
+	if v {
+		return x | 1<<bit
+	}
+	return x &^ (1 << bit)
+}
 
-	off := uint64(*r.Offset(q / 64))
-	if rep == q {
-		return q + off
+// runEndFrom returns the slot that ends the run for the largest occupied
+// quotient at most quo, starting from the offset of block i. quo must be in
+// [64*i, 64*i + 64]. It reports false if there is no such run or if it ends
+// before quo, in which case no run for a quotient at most quo uses the slot.
+func (r *rsqfData) runEndFrom(i, quo uint64) (uint64, bool) {
+	start := 64 * i
+	end := start + uint64(*r.Offset(i))
+	ok := end > start || r.runend(start)
+
+	// the runs for the occupied quotients after the start of the block come
+	// in order after the end of the run for the start of the block.
+	if d := uint64(r.OccupiedRank(start+1, quo-start)); d > 0 {
+		if ok {
+			start = end + 1
+		}
+		end, ok = start+uint64(r.RunendsSelect(start, d-1)), true
 	}
 
-	d := uint64(r.OccupiedRank(rep+1, q-rep-1))
-	if d == 0 {
-		return rep + off
+	return end, ok && end >= quo
+}
+
+// runEnd returns the slot that ends the run for the largest occupied quotient
+// at most quo. It reports false if there is no such run or if it ends before
+// quo.
+func (r *rsqfData) runEnd(quo uint64) (uint64, bool) {
+	return r.runEndFrom(quo/64, quo)
+}
+
+// runStart returns the slot that starts the run for the occupied quotient.
+func (r *rsqfData) runStart(quo uint64) uint64 {
+	if quo == 0 {
+		return 0
+	}
+	if end, ok := r.runEnd(quo - 1); ok {
+		return end + 1
+	}
+	return quo
+}
+
+// fixOffset recomputes the offset for block i from the offset of block i-1.
+// It reports false if the offset is too large to store.
+func (r *rsqfData) fixOffset(i uint64) bool {
+	var end uint64
+	var ok bool
+
+	if i == 0 {
+		if r.occupied(0) {
+			end, ok = uint64(r.RunendsSelect(0, 0)), true
+		}
+	} else {
+		end, ok = r.runEndFrom(i-1, 64*i)
+	}
+
+	off := uint64(0)
+	if ok {
+		off = end - 64*i
+	}
+	if off > 255 {
+		return false
 	}
 
-	t := uint64(r.RunendsSelect(rep+off+1, d))
-	return rep + off + t + 1
+	*r.Offset(i) = uint8(off)
+	return true
 }
 
 // Lookup reports true for any hash that has been inserted and possibly for some
@@ -157,79 +271,485 @@ func (r *rsqfData) QuotientSlot(q uint64) uint64 {
 // has definitely not been inserted.
 func (r *rsqfData) Lookup(hash uint64) bool {
 	rem := hash & r.remMask
-	hash >>= r.rem
-	quo := hash & r.quoMask
+	quo := hash >> r.rem & r.quoMask
 
-	if r.Occupied(quo/64).toUint64()&(1<<quo%64-1) == 0 {
+	if !r.occupied(quo) {
 		return false
 	}
 
-	slot := r.QuotientSlot(quo)
-	block := slot / 64
-	rems := r.Remainders(block)
-	runs := r.Runends(block).toUint64()
-	idx := uint(slot % 64)
-	sel := uint64(1) << idx
+	// walk the run backwards. it starts either at the quotient or right after
+	// the end of the previous run. counter slots hold the count of an earlier
+	// remainder in the run.
+	end, _ := r.runEnd(quo)
+	for slot := end; ; slot-- {
+		if entry := r.entry(slot); entry&r.flag == 0 {
+			if slotRem := entry & r.remMask; slotRem == rem {
+				return true
+			} else if slotRem < rem {
+				return false
+			}
+		}
+		if slot == quo || r.runend(slot-1) {
+			return false
+		}
+	}
+}
 
-next:
-	slotRem := rems.Get(idx)
+// find returns the slot holding the hash.
+func (r *rsqfData) find(hash uint64) (uint64, bool) {
+	rem := hash & r.remMask
+	quo := hash >> r.rem & r.quoMask
 
-	if slotRem == rem {
-		return true
-	} else if slotRem < rem || runs&sel != 0 {
-		return false
+	if !r.occupied(quo) {
+		return 0, false
 	}
 
-	if idx > 0 {
-		idx--
-		sel >>= 1
-		goto next
-	} else if block > 0 {
-		block--
-		rems = r.Remainders(block)
-		runs = r.Runends(block).toUint64()
-		idx = 63
-		sel = 1 << 63
-		goto next
+	end, _ := r.runEnd(quo)
+	for slot := r.runStart(quo); slot <= end; slot++ {
+		if entry := r.entry(slot); entry&r.flag != 0 {
+			continue
+		} else if slotRem := entry & r.remMask; slotRem == rem {
+			return slot, true
+		} else if slotRem > rem {
+			break
+		}
 	}
+	return 0, false
+}
 
-	return false
+// Count returns the number of times the hash was inserted, which is at most
+// one unless the filter is counting.
+func (r *rsqfData) Count(hash uint64) uint64 {
+	slot, ok := r.find(hash)
+	if !ok {
+		return 0
+	}
+	n, _ := r.extra(slot)
+	return n + 1
+}
+
+// Get returns the value stored with the hash.
+func (r *rsqfData) Get(hash uint64) (uint64, bool) {
+	slot, ok := r.find(hash)
+	if !ok {
+		return 0, false
+	}
+	return r.value(slot), true
 }
 
 // Insert adds the hash to the filter so that Lookup will definitely report
-// yes. If insert reports false, then the filter is in a broken state and no
-// further operations should be performed on it. This should never happen if
-// the hashes are randomly distributed.
+// yes. If insert reports false, then there was no room for it and the filter
+// is unchanged. This should never happen if the hashes are randomly
+// distributed and the filter has room.
 func (r *rsqfData) Insert(hash uint64) bool {
+	_, ok := r.insert(hash, 0, 1)
+	return ok
+}
+
+// insert is like Insert but stores the value with the hash, replacing it if
+// the hash is already present, and inserts it n times if the filter is
+// counting. It also returns the number of slots it used.
+func (r *rsqfData) insert(hash, value, n uint64) (int, bool) {
 	rem := hash & r.remMask
-	hash >>= r.rem
-	quo := hash & r.quoMask
-	qblock, qidx := quo/64, uint(quo%64)
+	quo := hash >> r.rem & r.quoMask
+	entry := rem | value<<r.rem
+
+	if slot, ok := r.find(hash); ok {
+		used := 0
+		if r.flag != 0 {
+			extra, k := r.extra(slot)
+			if used, ok = r.setExtra(quo, slot, k, extra+n); !ok {
+				return 0, false
+			}
+		}
+		r.setEntry(slot, entry)
+		return used, true
+	}
+
+	// the remainder goes in its sorted position in the run for the quotient
+	// if it has one, and otherwise right after the runs for the earlier
+	// quotients.
+	slot := quo
+	if r.occupied(quo) {
+		end, _ := r.runEnd(quo)
+		for slot = r.runStart(quo); slot <= end; slot++ {
+			if entry := r.entry(slot); entry&r.flag == 0 && entry&r.remMask > rem {
+				break
+			}
+		}
+	} else if prev, ok := r.runEnd(quo); ok {
+		slot = prev + 1
+	}
+
+	if !r.insertAt(quo, slot, entry) {
+		return 0, false
+	}
+	if r.flag == 0 || n == 1 {
+		return 1, true
+	}
+	used, ok := r.setExtra(quo, slot, 0, n-1)
+	if !ok {
+		r.removeAt(quo, slot)
+		return 0, false
+	}
+	return used + 1, true
+}
+
+// insertAt shifts the slots from slot up to the first unused one over by one
+// and puts the entry in the slot as part of the run for the quotient. It
+// reports false without changing the filter if there is no room.
+func (r *rsqfData) insertAt(quo, slot, entry uint64) bool {
+	occupied := r.occupied(quo)
+	end, _ := r.runEnd(quo)
+
+	unused := r.findUnused(slot)
+	if unused >= r.slots() {
+		return false
+	}
+
+	// shift everything up to the first unused slot over by one
+	for s := unused; s > slot; s-- {
+		r.setEntry(s, r.entry(s-1))
+		r.setRunend(s, r.runend(s-1))
+	}
+	r.setEntry(slot, entry)
+
+	switch {
+	case !occupied:
+		r.setOccupied(quo, true)
+		r.setRunend(slot, true)
+	case slot == end+1:
+		r.setRunend(end, false)
+		r.setRunend(slot, true)
+	default:
+		r.setRunend(slot, false)
+	}
 
-	slot := r.QuotientSlot(quo)
-	fmt.Printf("quo:%d rem:%d slot:%d\n", quo, rem, slot)
+	// every block between the quotient and the unused slot may have had the
+	// end of its run moved.
+	for i := quo / 64; i <= unused/64; i++ {
+		if r.fixOffset(i) {
+			continue
+		}
+
+		// undo the insert. the offsets are recomputed in order, so each one
+		// is from an offset that is already restored.
+		switch {
+		case !occupied:
+			r.setOccupied(quo, false)
+		case slot == end+1:
+			r.setRunend(end, true)
+		}
+		r.shiftBack(slot, unused)
+		for i := quo / 64; i <= unused/64; i++ {
+			r.fixOffset(i)
+		}
+		return false
+	}
+
+	return true
+}
+
+// extra returns the count held by the counter slots after the slot and how
+// many of them there are.
+func (r *rsqfData) extra(slot uint64) (n uint64, k uint) {
+	if r.flag == 0 {
+		return 0, 0
+	}
+	for ; !r.runend(slot) && r.counter(slot+1); slot++ {
+		n |= r.entry(slot+1) &^ r.flag << (k * (r.rem + r.val))
+		k++
+	}
+	return n, k
+}
 
-	occs := r.Occupied(qblock)
-	if quo > slot || (quo == slot && quo == qblock*64 && occs.toUint64()&(1<<qidx) == 0) {
-		rems := r.Remainders(qblock)
-		rems.Put(qidx, rem)
-		occs := r.Occupied(qblock)
-		*occs = toU64(occs.toUint64() | 1<<qidx)
-		ends := r.Runends(qblock)
-		*ends = toU64(ends.toUint64() | 1<<qidx)
-		return true
+// setExtra stores n in the k counter slots after the slot in the run for the
+// quotient, inserting or removing counter slots as needed. It returns the
+// change in the number of slots used, and reports false without changing the
+// filter if there is no room.
+func (r *rsqfData) setExtra(quo, slot uint64, k uint, n uint64) (int, bool) {
+	d := r.rem + r.val
+	need := counterSlots(n, d)
+
+	// insert the new digits first so that if one does not fit, the ones
+	// before it are all that have to be removed.
+	for i := k; i < need; i++ {
+		if !r.insertAt(quo, slot+1+uint64(i), r.flag|counterDigit(n, d, i)) {
+			for ; i > k; i-- {
+				r.removeAt(quo, slot+uint64(i))
+			}
+			return 0, false
+		}
+	}
+	for i := uint(0); i < k && i < need; i++ {
+		r.setEntry(slot+1+uint64(i), r.flag|counterDigit(n, d, i))
+	}
+	for i := need; i < k; i++ {
+		r.removeAt(quo, slot+1+uint64(need))
+	}
+	return int(need) - int(k), true
+}
+
+// Remove removes the hash from the filter, reporting if it was present. If
+// the filter is counting, it removes one of the times it was inserted.
+func (r *rsqfData) Remove(hash uint64) bool {
+	_, ok := r.remove(hash)
+	return ok
+}
+
+// remove is like Remove but also returns the number of slots it freed.
+func (r *rsqfData) remove(hash uint64) (int, bool) {
+	slot, ok := r.find(hash)
+	if !ok {
+		return 0, false
+	}
+
+	quo := hash >> r.rem & r.quoMask
+	if n, k := r.extra(slot); n > 0 {
+		// removing a counter slot always has room.
+		used, _ := r.setExtra(quo, slot, k, n-1)
+		return -used, true
+	}
+	r.removeAt(quo, slot)
+	return 1, true
+}
+
+// removeAt removes the slot from the run for the quotient. The runs after it
+// in its cluster that were shifted are shifted back.
+func (r *rsqfData) removeAt(quo, slot uint64) {
+	start := r.runStart(quo)
+	end, _ := r.runEnd(quo)
+
+	// find the end of the runs that have to move back. a run moves if it was
+	// shifted past its quotient, and the first one that was not ends it.
+	last := end
+	for next := quo + 1; ; {
+		nquo, ok := r.nextOccupied(next)
+		if !ok || nquo > last {
+			break
+		}
+		last, _ = r.runEnd(nquo)
+		next = nquo + 1
+	}
+	r.shiftBack(slot, last)
+
+	switch {
+	case start == end:
+		r.setOccupied(quo, false)
+	case slot == end:
+		r.setRunend(end-1, true)
+	}
+
+	for i := quo / 64; i <= last/64; i++ {
+		// offsets only shrink, so they always fit.
+		r.fixOffset(i)
+	}
+}
+
+// shiftBack moves the slots after the slot up to last back by one, leaving
+// last unused.
+func (r *rsqfData) shiftBack(slot, last uint64) {
+	for s := slot; s < last; s++ {
+		r.setEntry(s, r.entry(s+1))
+		r.setRunend(s, r.runend(s+1))
+	}
+	r.setEntry(last, 0)
+	r.setRunend(last, false)
+}
+
+// findUnused finds the first unused slot at or after the slot.
+func (r *rsqfData) findUnused(slot uint64) uint64 {
+	for slot < r.slots() {
+		end, ok := r.runEnd(slot)
+		if !ok {
+			break
+		}
+		slot = end + 1
+	}
+	return slot
+}
+
+//
+// filter
+//
+
+// rsqFil is a rank/select quotient filter that keeps track of its length so
+// that it can be used as a level.
+type rsqFil struct {
+	*rsqfData
+	len uint
+}
+
+func newRSQFil(q, r, v uint, buf []byte) *rsqFil {
+	if buf == nil {
+		buf = make([]byte, rsqfSize(q, r+v))
+	}
+	return &rsqFil{rsqfData: newRSQFData(buf, q, r, v)}
+}
+
+// newCountingRSQFil is like newRSQFil but for a counting filter. A hash added
+// n times is stored in its slot followed by counter slots holding n-1 in
+// digits of r+v bits, least significant first.
+func newCountingRSQFil(q, r, v uint, buf []byte) *rsqFil {
+	f := newRSQFil(q, r, v+1, buf)
+	f.val, f.flag = v, 1<<(r+v)
+	return f
+}
+
+func (r *rsqFil) Empty() bool         { return r.len == 0 }
+func (r *rsqFil) Len() uint           { return r.len }
+func (r *rsqFil) Cap() uint           { return 1 << r.quo }
+func (r *rsqFil) Bits() uint          { return r.quo + r.rem }
+func (r *rsqFil) QuotientBits() uint  { return r.quo }
+func (r *rsqFil) RemainderBits() uint { return r.rem }
+
+func (r *rsqFil) buffer() []byte   { return r.buf }
+func (r *rsqFil) setLen(n uint)    { r.len = n }
+func (r *rsqFil) builder() builder { return rsqfBuilder{r} }
+
+func (r *rsqFil) Clear() {
+	r.len = 0
+	for i := range r.buf {
+		r.buf[i] = 0
+	}
+}
+
+// count returns the number of slots in use by walking every run.
+func (r *rsqFil) count() (n uint) {
+	for it := r.iter(); it.Next(); {
+		n += 1 + counterSlots(it.count-1, r.rem+r.val)
+	}
+	return n
+}
+
+func (r *rsqFil) Add(hash uint64) bool { return r.AddValue(hash, 0) }
+
+func (r *rsqFil) AddValue(hash, value uint64) bool { return r.AddCount(hash, value, 1) }
+
+// AddCount adds the hash to the filter n times with the value, reporting
+// false without changing the filter if there was no room for it.
+func (r *rsqFil) AddCount(hash, value, n uint64) bool {
+	used, ok := r.insert(hash, value, n)
+	r.len += uint(used)
+	return ok
+}
+
+// rsqfBuilder fills the filter by inserting, which only shifts within the
+// last run when the hashes are sorted.
+type rsqfBuilder struct{ r *rsqFil }
+
+func (b rsqfBuilder) Add(hash, value, n uint64) bool { return b.r.AddCount(hash, value, n) }
+
+// Remove removes the hash from the filter, reporting if it was present.
+func (r *rsqFil) Remove(hash uint64) bool {
+	freed, ok := r.remove(hash)
+	r.len -= uint(freed)
+	return ok
+}
+
+func (r *rsqFil) Iter() iterator {
+	it := r.iter()
+	it.empty = r.len == 0
+	return it
+}
+
+// rsqfIter walks the hashes in sorted order. The runs are stored in quotient
+// order, so the nth run belongs to the nth occupied quotient.
+type rsqfIter struct {
+	r     *rsqfData
+	quo   uint64 // quotient of the current run
+	next  uint64 // quotient to start looking for the next run at
+	slot  uint64 // slot of the next hash
+	run   bool   // if the next hash is in the current run
+	empty bool   // the filter has no hashes, so its vectors are not read
+	hash  uint64
+	value uint64
+	count uint64
+}
+
+// iter returns an iterator that reads the vectors even if the length is zero,
+// so that count can recover the length of a buffer filled by another filter.
+func (r *rsqFil) iter() *rsqfIter { return &rsqfIter{r: r.rsqfData} }
+
+// Seek moves the iterator so that Next yields the hashes at least hash. The
+// run for the first occupied quotient at least the quotient of the hash starts
+// after the runs for the quotients before it.
+func (it *rsqfIter) Seek(hash uint64) {
+	r := it.r
+	if it.empty {
+		return
+	}
+	hash &= 1<<(r.quo+r.rem) - 1
+	quo := hash >> r.rem
+
+	it.next, it.slot, it.run = quo, 0, false
+	if quo > 0 {
+		if end, ok := r.runEnd(quo - 1); ok {
+			it.slot = end + 1
+		}
+	}
+
+	for it.load() && it.quo<<r.rem|r.remainder(it.slot) < hash {
+		_, k := r.extra(it.slot)
+		it.skip(k)
+	}
+}
+
+// skip moves past the next slot and the k counter slots after it.
+func (it *rsqfIter) skip(k uint) {
+	it.slot += uint64(k)
+	it.run = !it.r.runend(it.slot)
+	it.slot++
+}
+
+// load moves to the run for the next occupied quotient if the current run is
+// over, reporting false if there are no more hashes. the run starts either
+// right after the previous run or in its canonical slot.
+func (it *rsqfIter) load() bool {
+	r := it.r
+	if it.empty {
+		return false
+	}
+	if !it.run {
+		quo, ok := r.nextOccupied(it.next)
+		if !ok {
+			return false
+		}
+		it.quo, it.next, it.run = quo, quo+1, true
+		if it.slot < quo {
+			it.slot = quo
+		}
+	}
+	return it.slot < r.slots()
+}
+
+func (it *rsqfIter) Next() bool {
+	if !it.load() {
+		return false
 	}
 
-	return false
+	r := it.r
+	it.hash = it.quo<<r.rem | r.remainder(it.slot)
+	it.value = r.value(it.slot)
+	extra, k := r.extra(it.slot)
+	it.count = extra + 1
+	it.skip(k)
+	return true
 }
 
-// findUnused finds the first unused slot after the quotient.
-func (r *rsqfData) findUnused(quo uint64) uint64 {
-next:
-	end := r.QuotientSlot(quo)
-	if quo > end {
-		return quo
+func (it *rsqfIter) Hash() uint64  { return it.hash }
+func (it *rsqfIter) Value() uint64 { return it.value }
+func (it *rsqfIter) Count() uint64 { return it.count }
+
+// nextOccupied returns the first occupied quotient at or after quo.
+func (r *rsqfData) nextOccupied(quo uint64) (uint64, bool) {
+	for max := r.quoMask; quo <= max; {
+		occ := r.Occupied(quo/64).toUint64() >> (quo % 64)
+		if occ != 0 {
+			quo += uint64(bits.TrailingZeros64(occ))
+			return quo, quo <= max
+		}
+		quo = (quo/64 + 1) * 64
 	}
-	quo = end + 1
-	goto next
+	return 0, false
 }
@@ -1,18 +1,17 @@
 package cascade
 
 import (
-	"encoding/binary"
-	"fmt"
 	"math"
 	"testing"
 
 	"github.com/zeebo/assert"
+	"github.com/zeebo/pcg"
 )
 
 func TestRSQFData(t *testing.T) {
 	t.Run("Rank", func(t *testing.T) {
 		buf := make([]byte, 1024) // way too big
-		data := newRSQFData(buf, 1, 1)
+		data := newRSQFData(buf, 1, 1, 0)
 
 		*data.Occupied(0) = toU64(math.MaxUint64)
 		*data.Occupied(1) = toU64(math.MaxUint64)
@@ -23,7 +22,7 @@ func TestRSQFData(t *testing.T) {
 
 	t.Run("Select", func(t *testing.T) {
 		buf := make([]byte, 1024) // way too big
-		data := newRSQFData(buf, 1, 1)
+		data := newRSQFData(buf, 1, 1, 0)
 
 		*data.Runends(0) = toU64(math.MaxUint64)
 		*data.Runends(1) = toU64(math.MaxUint64)
@@ -38,39 +37,343 @@ func TestRSQFData(t *testing.T) {
 		}
 	})
 
+	t.Run("Rank Empty", func(t *testing.T) {
+		buf := make([]byte, 1024) // way too big
+		data := newRSQFData(buf, 1, 1, 0)
+
+		*data.Occupied(0) = toU64(math.MaxUint64)
+
+		assert.Equal(t, data.OccupiedRank(5, 0), uint(0))
+	})
+
 	t.Run("Insert", func(t *testing.T) {
-		buf := make([]byte, 2*(17+8))
-		data := newRSQFData(buf, 7, 1)
+		const q, r = 10, 6
+		data := newRSQFData(make([]byte, rsqfSize(q, r)), q, r, 0)
+		mask := uint64(1<<(q+r) - 1)
+
+		set := make(map[uint64]bool)
+		for len(set) < 1<<q*9/10 {
+			x := pcg.Uint64() & mask
+			assert.That(t, data.Insert(x))
+			set[x] = true
+		}
+
+		for x := range set {
+			assert.That(t, data.Lookup(x))
+		}
+		for i := 0; i < 100000; i++ {
+			x := pcg.Uint64()
+			assert.Equal(t, data.Lookup(x), set[x&mask])
+		}
+	})
+
+	t.Run("Insert Clustered", func(t *testing.T) {
+		const q, r = 8, 4
+		data := newRSQFData(make([]byte, rsqfSize(q, r)), q, r, 0)
+
+		// every remainder of a few adjacent quotients spanning a block
+		// boundary, inserted in descending order.
+		for quo := uint64(70); quo >= 60; quo-- {
+			for rem := uint64(1 << r); rem > 0; rem-- {
+				assert.That(t, data.Insert(quo<<r|(rem-1)))
+			}
+		}
+
+		for x := uint64(0); x < 1<<(q+r); x++ {
+			quo := x >> r
+			assert.Equal(t, data.Lookup(x), quo >= 60 && quo <= 70)
+		}
+	})
+
+	t.Run("Iterator", func(t *testing.T) {
+		const q, r = 10, 6
+		f := newRSQFil(q, r, 0, nil)
+		mask := uint64(1<<(q+r) - 1)
+
+		set := make(map[uint64]bool)
+		for len(set) < 1<<q*3/4 {
+			x := pcg.Uint64() & mask
+			assert.That(t, f.Add(x))
+			set[x] = true
+		}
+		assert.Equal(t, f.Len(), uint(len(set)))
+		assert.Equal(t, f.count(), f.Len())
+
+		// a builder fed the sorted hashes produces the same buffer.
+		f2 := newRSQFil(q, r, 0, nil)
+		b, n, last := f2.builder(), 0, uint64(0)
+		for it := f.Iter(); it.Next(); n++ {
+			assert.That(t, n == 0 || it.Hash() > last)
+			assert.That(t, set[it.Hash()])
+			last = it.Hash()
+			assert.That(t, b.Add(it.Hash(), it.Value(), it.Count()))
+		}
+		assert.Equal(t, n, len(set))
+		assert.Equal(t, f2.Len(), f.Len())
+		assert.DeepEqual(t, f2.buf, f.buf)
+	})
+
+	t.Run("Iterator Empty", func(t *testing.T) {
+		// an empty filter does not read its buffer, which may have been
+		// discarded, so one that is too short to read is fine.
+		f := newRSQFil(10, 6, 0, []byte{})
+		it := f.Iter()
+		assert.That(t, !it.Next())
+		it.Seek(1234)
+		assert.That(t, !it.Next())
+	})
+
+	t.Run("Oracle", func(t *testing.T) {
+		const q, r = 8, 3
+		f := newRSQFil(q, r, 0, nil)
+		mask := uint64(1<<(q+r) - 1)
+		set := make(map[uint64]bool)
+
+		check := func() {
+			// every fingerprint is present exactly when the oracle says so.
+			for x := uint64(0); x <= mask; x++ {
+				assert.Equal(t, f.Lookup(x), set[x])
+			}
+
+			// the iterator yields the oracle in sorted order.
+			n, last := 0, uint64(0)
+			for it := f.Iter(); it.Next(); n++ {
+				assert.That(t, n == 0 || it.Hash() > last)
+				assert.That(t, set[it.Hash()])
+				last = it.Hash()
+			}
+			assert.Equal(t, n, len(set))
+			assert.Equal(t, f.Len(), uint(len(set)))
 
-		p := func(block uint64) {
-			fmt.Printf("off:%d occ:%064b end:%064b rem:%064b\n",
-				*data.Offset(block),
-				data.Occupied(block).toUint64(),
-				data.Runends(block).toUint64(),
-				binary.LittleEndian.Uint64(data.Remainders(block).buf))
+			// the offsets are the same as if they were recomputed.
+			g := newRSQFil(q, r, 0, append([]byte(nil), f.buf...))
+			for i := uint64(0); i < g.slots()/64; i++ {
+				assert.That(t, g.fixOffset(i))
+			}
+			assert.DeepEqual(t, g.buf, f.buf)
 		}
 
-		data.Insert(0 << 1)
-		p(0)
-		p(1)
+		for i := 0; i < 5000; i++ {
+			x := pcg.Uint64() & mask
 
-		data.Insert(1 << 1)
-		p(0)
-		p(1)
+			// keep the load between a half and nine tenths so that there
+			// are long clusters to shift around.
+			switch load := len(set) * 10 >> q; {
+			case load < 5 || (load < 9 && pcg.Uint32n(2) == 0):
+				assert.That(t, f.Add(x))
+				set[x] = true
+			default:
+				assert.Equal(t, f.Remove(x), set[x])
+				delete(set, x)
 
-		data.Insert(64 << 1)
-		p(0)
-		p(1)
+				// remove something that is definitely present, too.
+				for y := range set {
+					assert.That(t, f.Remove(y))
+					delete(set, y)
+					break
+				}
+			}
 
-		data.Insert(65 << 1)
-		p(0)
-		p(1)
+			if i%50 == 0 {
+				check()
+			}
+		}
+		check()
+
+		for x := range set {
+			assert.That(t, f.Remove(x))
+		}
+		assert.That(t, f.Empty())
+		assert.DeepEqual(t, f.buf, make([]byte, len(f.buf)))
+	})
+
+	t.Run("Counting Oracle", func(t *testing.T) {
+		const q, r = 8, 3
+		f := newCountingRSQFil(q, r, 0, nil)
+		mask := uint64(1<<(q+r) - 1)
+		counts := make(map[uint64]uint64)
+		total := uint(0)
+
+		// a small pool of hashes so that each is added many times.
+		pool := make([]uint64, 64)
+		for i := range pool {
+			pool[i] = pcg.Uint64() & mask
+		}
+
+		check := func() {
+			for _, x := range pool {
+				assert.Equal(t, f.Count(x), counts[x])
+				assert.Equal(t, f.Lookup(x), counts[x] > 0)
+			}
+
+			// the iterator yields every hash once with its count in sorted
+			// order.
+			n, last := uint(0), uint64(0)
+			for it := f.Iter(); it.Next(); {
+				assert.That(t, n == 0 || it.Hash() > last)
+				assert.Equal(t, it.Count(), counts[it.Hash()])
+				n += uint(it.Count())
+				last = it.Hash()
+			}
+			assert.Equal(t, n, total)
+			assert.Equal(t, f.Len(), f.count())
+
+			g := newCountingRSQFil(q, r, 0, append([]byte(nil), f.buf...))
+			for i := uint64(0); i < g.slots()/64; i++ {
+				assert.That(t, g.fixOffset(i))
+			}
+			assert.DeepEqual(t, g.buf, f.buf)
+		}
+
+		for i := 0; i < 5000; i++ {
+			x := pool[pcg.Uint32n(uint32(len(pool)))]
+
+			switch load := f.Len() * 10 >> q; {
+			case load < 5 || (load < 9 && pcg.Uint32n(2) == 0):
+				assert.That(t, f.Add(x))
+				counts[x]++
+				total++
+			default:
+				assert.Equal(t, f.Remove(x), counts[x] > 0)
+				if counts[x] > 0 {
+					counts[x]--
+					total--
+				}
+			}
+
+			if i%50 == 0 {
+				check()
+			}
+		}
+		check()
+	})
+
+	t.Run("Counting Hot", func(t *testing.T) {
+		const q, r = 8, 4
+		f := newCountingRSQFil(q, r, 0, nil)
+
+		// a hash added many times only takes a few counter slots, so its
+		// cluster stays short.
+		const hot = 0x155
+		for i := 0; i < 100000; i++ {
+			assert.That(t, f.Add(hot))
+		}
+		assert.Equal(t, f.Count(hot), uint64(100000))
+		assert.Equal(t, f.Len(), uint(1+5))
+		assert.Equal(t, f.count(), f.Len())
+
+		for i := 0; i < 100000; i++ {
+			assert.That(t, f.Remove(hot))
+		}
+		assert.That(t, f.Empty())
+		assert.DeepEqual(t, f.buf, make([]byte, len(f.buf)))
+	})
+
+	t.Run("Insert Long Cluster", func(t *testing.T) {
+		const q, r = 10, 8
+		data := newRSQFData(make([]byte, rsqfSize(q, r)), q, r, 0)
+
+		// every remainder of the first quotients makes a cluster too long
+		// for the offsets, and the insert that finds that out leaves the
+		// filter unchanged.
+		for x := uint64(0); ; x++ {
+			buf := append([]byte(nil), data.buf...)
+			if !data.Insert(x) {
+				assert.DeepEqual(t, data.buf, buf)
+				for y := uint64(0); y < x+1000; y++ {
+					assert.Equal(t, data.Lookup(y), y < x)
+				}
+				break
+			}
+		}
+	})
+
+	t.Run("Values", func(t *testing.T) {
+		const q, r, v = 10, 6, 20
+		f := newRSQFil(q, r, v, nil)
+		mask := uint64(1<<(q+r) - 1)
+		e := make(map[uint64]uint64)
+
+		for len(e) < 1<<q*3/4 {
+			x := pcg.Uint64() & mask
+			val := pcg.Uint64() & (1<<v - 1)
+			assert.That(t, f.AddValue(x, val))
+			e[x] = val
+		}
+
+		check := func() {
+			for x, val := range e {
+				got, ok := f.Get(x)
+				assert.That(t, ok)
+				assert.Equal(t, got, val)
+			}
+			for it := f.Iter(); it.Next(); {
+				assert.Equal(t, it.Value(), e[it.Hash()])
+			}
+		}
+		check()
+
+		// adding again replaces the value, and removing shifts the values
+		// along with the remainders.
+		n := 0
+		for x := range e {
+			if n++; n%2 == 0 {
+				assert.That(t, f.Remove(x))
+				delete(e, x)
+			} else {
+				assert.That(t, f.AddValue(x, e[x]^1))
+				e[x] ^= 1
+			}
+		}
+		assert.Equal(t, f.Len(), uint(len(e)))
+		check()
+	})
+
+	t.Run("Seek", func(t *testing.T) {
+		const q, r = 8, 3
+		f := newRSQFil(q, r, 0, nil)
+		for f.Len() < 1<<q*3/4 {
+			f.Add(pcg.Uint64())
+		}
+
+		var all []uint64
+		for it := f.Iter(); it.Next(); {
+			all = append(all, it.Hash())
+		}
+
+		it := f.Iter()
+		for j := 0; j < 100; j++ {
+			target := pcg.Uint64() & (1<<(q+r) - 1)
+			it.Seek(target)
+
+			rest := all
+			for len(rest) > 0 && rest[0] < target {
+				rest = rest[1:]
+			}
+			for _, x := range rest {
+				assert.That(t, it.Next())
+				assert.Equal(t, it.Hash(), x)
+			}
+			assert.That(t, !it.Next())
+		}
+	})
+
+	t.Run("Insert Full", func(t *testing.T) {
+		const q, r = 7, 1
+		data := newRSQFData(make([]byte, 2*(17+8)), q, r, 0)
+
+		// without any extra blocks, the runs eventually have nowhere to go.
+		ok := true
+		for x := uint64(0); ok && x < 1<<(q+r); x++ {
+			ok = data.Insert(x)
+		}
+		assert.That(t, !ok)
 	})
 }
 
 func BenchmarkRSQFData(b *testing.B) {
 	buf := make([]byte, 1024) // way too big
-	data := newRSQFData(buf, 1, 1)
+	data := newRSQFData(buf, 1, 1, 0)
 
 	*data.Occupied(0) = toU64(math.MaxUint64)
 	*data.Occupied(1) = toU64(math.MaxUint64)
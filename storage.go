@@ -0,0 +1,299 @@
+package cascade
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/zeebo/errs"
+	"golang.org/x/sys/unix"
+)
+
+// Storage holds the bytes of a filter. The header and every level live in
+// regions of it that are mapped into memory, and writes to the mapped bytes
+// are writes to the storage.
+type Storage interface {
+	// Size returns the number of bytes in the storage.
+	Size() (int64, error)
+
+	// Allocate resizes the storage to size bytes. Any bytes past the old
+	// size read as zero. The new size is durable when it returns.
+	Allocate(size int64) error
+
+	// Map returns the size bytes starting at off, which is a multiple of the
+	// page size. The bytes are valid until Release is called.
+	Map(off, size int64) ([]byte, error)
+
+	// Sync makes the writes to bytes returned by Map durable.
+	Sync(buf []byte) error
+
+	// Discard releases the bytes of buf, which was returned by Map for the
+	// region starting at off. They read as zero afterward and take no space
+	// until they are written again. It is durable when it returns.
+	Discard(off int64, buf []byte) error
+
+	// Allocated returns the number of bytes of disk or memory used by the
+	// storage, which is less than its size when regions are discarded.
+	Allocated() (int64, error)
+
+	// Release releases every mapping. The storage may be mapped again
+	// afterward, such as to reopen a filter.
+	Release() error
+}
+
+//
+// file
+//
+
+// fileStorage maps regions of a file with mmap.
+type fileStorage struct {
+	fh *os.File
+
+	mu       sync.Mutex
+	mappings [][]byte
+}
+
+// NewFileStorage returns a Storage that maps regions of the file. Closing the
+// file is left to the caller.
+func NewFileStorage(fh *os.File) Storage {
+	return &fileStorage{fh: fh}
+}
+
+func (f *fileStorage) Size() (int64, error) {
+	fi, err := f.fh.Stat()
+	if err != nil {
+		return 0, errs.Wrap(err)
+	}
+	return fi.Size(), nil
+}
+
+func (f *fileStorage) Allocate(size int64) error {
+	if err := f.fh.Truncate(size); err != nil {
+		return errs.Wrap(err)
+	}
+	return errs.Wrap(f.fh.Sync())
+}
+
+func (f *fileStorage) Map(off, size int64) ([]byte, error) {
+	buf, err := unix.Mmap(int(f.fh.Fd()), off, int(size),
+		unix.PROT_WRITE|unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+
+	f.mu.Lock()
+	f.mappings = append(f.mappings, buf)
+	f.mu.Unlock()
+
+	return buf, nil
+}
+
+func (f *fileStorage) Sync(buf []byte) error {
+	return errs.Wrap(unix.Msync(buf, unix.MS_SYNC))
+}
+
+func (f *fileStorage) Discard(off int64, buf []byte) error {
+	return errs.Wrap(punch(f.fh, off, buf))
+}
+
+func (f *fileStorage) Allocated() (int64, error) {
+	fi, err := f.fh.Stat()
+	if err != nil {
+		return 0, errs.Wrap(err)
+	}
+	return allocated(fi), nil
+}
+
+func (f *fileStorage) Release() (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, m := range f.mappings {
+		if merr := unix.Munmap(m); err == nil {
+			err = merr
+		}
+	}
+	f.mappings = nil
+	return errs.Wrap(err)
+}
+
+// allocated returns the number of bytes of disk used by the file.
+func allocated(fi os.FileInfo) int64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int64(st.Blocks) * 512
+	}
+	return fi.Size()
+}
+
+// zero zeroes the mapped bytes and syncs them.
+func zero(buf []byte) error {
+	for i := range buf {
+		buf[i] = 0
+	}
+	return errs.Wrap(unix.Msync(buf, unix.MS_SYNC))
+}
+
+// resident returns the number of bytes of the mapping that are in memory.
+func resident(buf []byte) (int64, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	ps := pageSize()
+	vec := make([]byte, (int64(len(buf))+ps-1)/ps)
+	_, _, errno := unix.Syscall(unix.SYS_MINCORE,
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)), uintptr(unsafe.Pointer(&vec[0])))
+	if errno != 0 {
+		return 0, errs.Wrap(errno)
+	}
+
+	n := int64(0)
+	for _, v := range vec {
+		if v&1 != 0 {
+			n += ps
+		}
+	}
+	return n, nil
+}
+
+//
+// memory
+//
+
+// memStorage keeps the bytes in anonymous mappings. Every allocation that
+// grows it is a separate mapping so that the bytes already mapped do not
+// move, so a mapping must be within a single allocation. Filters only map
+// regions that they allocated all at once.
+type memStorage struct {
+	mu      sync.Mutex
+	chunks  []memChunk
+	dropped [][]byte // mappings of chunks dropped by shrinking
+}
+
+type memChunk struct {
+	off int64
+	buf []byte
+	mem []byte // the whole mapping, which buf may be a prefix of
+}
+
+// NewMemStorage returns a Storage that keeps the bytes in memory. Nothing is
+// durable, but a filter closed on it may be reopened from it. The memory is
+// returned when the storage is garbage collected.
+func NewMemStorage() Storage {
+	m := new(memStorage)
+	runtime.SetFinalizer(m, (*memStorage).free)
+	return m
+}
+
+// free unmaps every chunk.
+func (m *memStorage) free() {
+	for _, c := range m.chunks {
+		_ = unix.Munmap(c.mem)
+	}
+	for _, mem := range m.dropped {
+		_ = unix.Munmap(mem)
+	}
+	m.chunks, m.dropped = nil, nil
+}
+
+func (m *memStorage) size() int64 {
+	if len(m.chunks) == 0 {
+		return 0
+	}
+	last := m.chunks[len(m.chunks)-1]
+	return last.off + int64(len(last.buf))
+}
+
+func (m *memStorage) Size() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.size(), nil
+}
+
+func (m *memStorage) Allocate(size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if size < 0 {
+		return errs.New("invalid size: %d", size)
+	}
+
+	// drop or shorten the allocations past the new size. they may still be
+	// mapped, so they are only unmapped by Release.
+	for len(m.chunks) > 0 {
+		last := &m.chunks[len(m.chunks)-1]
+		if last.off >= size {
+			m.dropped = append(m.dropped, last.mem)
+			m.chunks = m.chunks[:len(m.chunks)-1]
+			continue
+		}
+		if end := last.off + int64(len(last.buf)); end > size {
+			last.buf = last.buf[:size-last.off]
+		}
+		break
+	}
+
+	if cur := m.size(); size > cur {
+		mem, err := unix.Mmap(-1, 0, int(size-cur),
+			unix.PROT_WRITE|unix.PROT_READ, unix.MAP_PRIVATE|unix.MAP_ANON)
+		if err != nil {
+			return errs.Wrap(err)
+		}
+		m.chunks = append(m.chunks, memChunk{off: cur, buf: mem, mem: mem})
+	}
+	return nil
+}
+
+func (m *memStorage) Map(off, size int64) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, c := range m.chunks {
+		if off >= c.off && off+size <= c.off+int64(len(c.buf)) {
+			lo, hi := off-c.off, off-c.off+size
+			return c.buf[lo:hi:hi], nil
+		}
+	}
+	return nil, errs.New("region [%d, %d) is not within a single allocation", off, off+size)
+}
+
+func (m *memStorage) Sync(buf []byte) error { return nil }
+
+// Discard drops the pages of buf, which are zero filled when next touched.
+func (m *memStorage) Discard(off int64, buf []byte) error {
+	return errs.Wrap(unix.Madvise(buf, unix.MADV_DONTNEED))
+}
+
+// Allocated returns the number of bytes of the chunks that are in memory.
+func (m *memStorage) Allocated() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := int64(0)
+	for _, c := range m.chunks {
+		r, err := resident(c.buf)
+		if err != nil {
+			return 0, errs.Wrap(err)
+		}
+		n += r
+	}
+	return n, nil
+}
+
+// Release unmaps the chunks dropped by shrinking. The rest are kept so that
+// the storage may be mapped again.
+func (m *memStorage) Release() (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, mem := range m.dropped {
+		if merr := unix.Munmap(mem); err == nil {
+			err = merr
+		}
+	}
+	m.dropped = nil
+	return errs.Wrap(err)
+}
@@ -0,0 +1,27 @@
+//go:build linux
+// +build linux
+
+package cascade
+
+import (
+	"os"
+
+	"github.com/zeebo/errs"
+	"golang.org/x/sys/unix"
+)
+
+// punch punches a hole in the file where buf is mapped at off, which drops
+// the pages from the page cache and frees the blocks on disk. If the file
+// system does not support holes, the bytes are zeroed instead.
+func punch(fh *os.File, off int64, buf []byte) error {
+	err := unix.Fallocate(int(fh.Fd()),
+		unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, off, int64(len(buf)))
+	switch err {
+	case nil:
+		return errs.Wrap(fh.Sync())
+	case unix.EOPNOTSUPP, unix.ENOSYS:
+		return zero(buf)
+	default:
+		return errs.Wrap(err)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package cascade
+
+import "os"
+
+// punch zeroes the bytes where buf is mapped, since there is no portable way
+// to punch a hole in the file.
+func punch(fh *os.File, off int64, buf []byte) error {
+	return zero(buf)
+}
@@ -0,0 +1,138 @@
+package cascade
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/zeebo/assert"
+	"github.com/zeebo/pcg"
+)
+
+// punches reports if discarding part of a temporary file frees its blocks.
+// on a file system without holes, the bytes are only zeroed.
+func punches(t *testing.T) bool {
+	fh, err := ioutil.TempFile("", "cascade")
+	assert.NoError(t, err)
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	st := NewFileStorage(fh)
+	defer st.Release()
+
+	size := 4 * pageSize()
+	assert.NoError(t, st.Allocate(size))
+	buf, err := st.Map(0, size)
+	assert.NoError(t, err)
+	for i := range buf {
+		buf[i] = 1
+	}
+	assert.NoError(t, st.Sync(buf))
+
+	before, err := st.Allocated()
+	assert.NoError(t, err)
+	assert.NoError(t, st.Discard(0, buf))
+	after, err := st.Allocated()
+	assert.NoError(t, err)
+	return after < before
+}
+
+func TestStorage(t *testing.T) {
+	t.Run("Memory", func(t *testing.T) {
+		st := NewMemStorage()
+		assert.NoError(t, st.Allocate(4096))
+
+		a, err := st.Map(0, 4096)
+		assert.NoError(t, err)
+		a[10] = 1
+
+		// growing does not move the bytes that are already mapped.
+		assert.NoError(t, st.Allocate(3*4096))
+		b, err := st.Map(4096, 2*4096)
+		assert.NoError(t, err)
+		b[0] = 2
+
+		a2, err := st.Map(0, 4096)
+		assert.NoError(t, err)
+		assert.Equal(t, a2[10], byte(1))
+		a2[11] = 3
+		assert.Equal(t, a[11], byte(3))
+
+		_, err = st.Map(0, 2*4096)
+		assert.Error(t, err)
+
+		// shrinking and growing again reads as zero.
+		assert.NoError(t, st.Allocate(2*4096))
+		assert.NoError(t, st.Allocate(4*4096))
+		size, err := st.Size()
+		assert.NoError(t, err)
+		assert.Equal(t, size, int64(4*4096))
+
+		c, err := st.Map(2*4096, 2*4096)
+		assert.NoError(t, err)
+		assert.DeepEqual(t, c, make([]byte, 2*4096))
+	})
+
+	t.Run("Discard", func(t *testing.T) {
+		fh, err := ioutil.TempFile("", "cascade")
+		assert.NoError(t, err)
+		defer os.Remove(fh.Name())
+		defer fh.Close()
+
+		for _, st := range []Storage{NewFileStorage(fh), NewMemStorage()} {
+			size := 16 * pageSize()
+			assert.NoError(t, st.Allocate(size))
+			buf, err := st.Map(0, size)
+			assert.NoError(t, err)
+			for i := range buf {
+				buf[i] = 1
+			}
+			assert.NoError(t, st.Sync(buf))
+
+			before, err := st.Allocated()
+			assert.NoError(t, err)
+			assert.That(t, before >= size)
+
+			// the bytes no longer take up space and read as zero. a file
+			// system without holes only zeroes them.
+			assert.NoError(t, st.Discard(0, buf[:8*pageSize()]))
+			after, err := st.Allocated()
+			assert.NoError(t, err)
+			if _, ok := st.(*memStorage); ok || punches(t) {
+				assert.That(t, after <= before-8*pageSize())
+			}
+
+			assert.DeepEqual(t, buf[:8*pageSize()], make([]byte, 8*pageSize()))
+			assert.Equal(t, buf[8*pageSize()], byte(1))
+
+			assert.NoError(t, st.Release())
+		}
+	})
+
+	t.Run("Memory Filter", func(t *testing.T) {
+		for _, opts := range []Options{{}, {Background: true}} {
+			st := NewMemStorage()
+			cf, err := NewStorage(st, 20, opts)
+			assert.NoError(t, err)
+
+			var e []uint64
+			for i := 0; i < 20000; i++ {
+				x := pcg.Uint64()
+				e = append(e, x)
+				assert.NoError(t, cf.Add(x))
+			}
+			assert.That(t, len(cf.levels) > 2)
+			assert.NoError(t, cf.Close())
+
+			// the storage outlives the filter, so it can be reopened.
+			cf2, err := OpenStorage(st, Options{})
+			assert.NoError(t, err)
+			for _, v := range e {
+				ok, err := cf2.Lookup(v)
+				assert.NoError(t, err)
+				assert.That(t, ok)
+			}
+			assert.NoError(t, cf2.Close())
+		}
+	})
+}
@@ -0,0 +1,131 @@
+package cascade
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+//
+// a summary is a blocked bloom filter of the fingerprints in a level that is
+// kept in memory. every fingerprint sets three bits in a single word, so
+// checking it is one memory access that never touches the pages of the level.
+// it is sized by the number of fingerprints in the level rather than its
+// capacity. the deepest level, which holds most of the fingerprints, gets the
+// fewest bits per fingerprint, and every level above it gets enough more that
+// its false positive rate is lower in proportion to its capacity. the rates
+// then sum to about twice the rate of the deepest level however many levels
+// there are, rather than growing with them.
+//
+// levels past level 0 only gain fingerprints when a spill builds them, so
+// their summaries are built along with them and never change afterward.
+// removing a fingerprint leaves it in the summary, which only costs a probe.
+// the levels of an opened filter are summarized in the background, and a
+// summary is not used until it is ready, so that opening does not read every
+// level.
+//
+
+// summary is a blocked bloom filter of the fingerprints in a level. A nil
+// summary, or one that is not ready, has every fingerprint, so the level is
+// always probed.
+type summary struct {
+	mask  uint64 // mask of the fingerprint bits
+	words []uint64
+	done  uint32 // set atomically once every fingerprint is added
+}
+
+// newSummary returns an empty summary for a level with the given number of
+// fingerprints and fingerprint bits, using the bits of memory per
+// fingerprint. It returns nil if bitsPerHash is not positive.
+func newSummary(hashes uint64, bits uint, bitsPerHash int) *summary {
+	if bitsPerHash <= 0 {
+		return nil
+	}
+
+	n := (hashes*uint64(bitsPerHash) + 63) / 64
+	if n == 0 {
+		n = 1
+	}
+	return &summary{
+		mask:  1<<bits - 1,
+		words: make([]uint64, n),
+	}
+}
+
+// scaleSummaryBits returns the bits per fingerprint for the summary of a level
+// with shift fewer quotient bits than the deepest level, whose summary uses
+// bitsPerHash bits per fingerprint, so that its false positive rate is 2^-shift
+// of the rate of the deepest level. It is at most 64.
+func scaleSummaryBits(bitsPerHash int, shift uint) int {
+	if bitsPerHash <= 0 {
+		return bitsPerHash
+	}
+
+	target := summaryRate(bitsPerHash) * math.Exp2(-float64(shift))
+	bits := bitsPerHash
+	for bits < 64 && summaryRate(bits) > target {
+		bits++
+	}
+	return bits
+}
+
+// summaryRate returns the false positive rate of a summary with the bits per
+// fingerprint. the number of fingerprints in a word is about poisson, and a
+// word with k of them has about 1-(63/64)^3k of its bits set, the cube of
+// which is the rate.
+func summaryRate(bitsPerHash int) (rate float64) {
+	mean := 64 / float64(bitsPerHash)
+	p := math.Exp(-mean)
+	for k := 1; k < 256; k++ {
+		p *= mean / float64(k)
+		set := -math.Expm1(3 * float64(k) * math.Log1p(-1.0/64))
+		rate += p * set * set * set
+	}
+	return rate
+}
+
+// locate returns the word and bits that the fingerprint of the hash sets.
+func (s *summary) locate(hash uint64) (*uint64, uint64) {
+	x := (hash & s.mask) * 0x9e3779b97f4a7c15
+	x ^= x >> 29
+
+	word := &s.words[(x>>32)*uint64(len(s.words))>>32]
+	bits := uint64(1)<<(x&63) | uint64(1)<<(x>>6&63) | uint64(1)<<(x>>12&63)
+	return word, bits
+}
+
+// add adds the fingerprint of the hash. It must not be called once the
+// summary is ready.
+func (s *summary) add(hash uint64) {
+	if s == nil {
+		return
+	}
+	word, bits := s.locate(hash)
+	*word |= bits
+}
+
+// finish marks the summary as ready after every fingerprint is added.
+func (s *summary) finish() {
+	if s != nil {
+		atomic.StoreUint32(&s.done, 1)
+	}
+}
+
+// ready reports if every fingerprint has been added.
+func (s *summary) ready() bool { return atomic.LoadUint32(&s.done) != 0 }
+
+// has reports if the fingerprint of the hash may have been added.
+func (s *summary) has(hash uint64) bool {
+	if s == nil || !s.ready() {
+		return true
+	}
+	word, bits := s.locate(hash)
+	return *word&bits == bits
+}
+
+// bytes returns the size of the summary in memory.
+func (s *summary) bytes() int64 {
+	if s == nil {
+		return 0
+	}
+	return 8 * int64(len(s.words))
+}
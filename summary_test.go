@@ -0,0 +1,188 @@
+package cascade
+
+import (
+	"context"
+	"testing"
+
+	"github.com/zeebo/assert"
+	"github.com/zeebo/pcg"
+)
+
+func TestSummary(t *testing.T) {
+	t.Run("Basic", func(t *testing.T) {
+		const hashes, bits = 1 << 12, 20
+		s := newSummary(hashes, bits, 5)
+		assert.Equal(t, s.bytes(), int64(hashes*5/8))
+
+		var e []uint64
+		for i := 0; i < hashes; i++ {
+			x := pcg.Uint64()
+			e = append(e, x)
+			s.add(x)
+		}
+
+		// it has everything until it is ready.
+		assert.That(t, s.has(pcg.Uint64()))
+		s.finish()
+
+		// every added fingerprint is present, including with other high bits.
+		for _, x := range e {
+			assert.That(t, s.has(x))
+			assert.That(t, s.has(x^1<<bits))
+		}
+
+		got := 0
+		for i := 0; i < 10000; i++ {
+			if s.has(pcg.Uint64()) {
+				got++
+			}
+		}
+		assert.That(t, got < 1500)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		s := newSummary(1<<12, 20, -1)
+		assert.Nil(t, s)
+		s.add(1)
+		assert.That(t, s.has(2))
+		assert.Equal(t, s.bytes(), int64(0))
+	})
+
+	t.Run("Scale", func(t *testing.T) {
+		assert.Equal(t, scaleSummaryBits(3, 0), 3)
+		assert.Equal(t, scaleSummaryBits(-1, 4), -1)
+		assert.Equal(t, scaleSummaryBits(3, 40), 64)
+
+		// every level up gets more bits, enough to halve the rate.
+		rate := func(bits int) int {
+			s := newSummary(1<<14, 32, bits)
+			for i := 0; i < 1<<14; i++ {
+				s.add(pcg.Uint64())
+			}
+			s.finish()
+
+			n := 0
+			for i := 0; i < 100000; i++ {
+				if s.has(pcg.Uint64()) {
+					n++
+				}
+			}
+			return n
+		}
+		n := rate(3)
+		for shift := uint(1); shift < 8; shift++ {
+			assert.That(t, scaleSummaryBits(3, shift) > scaleSummaryBits(3, shift-1))
+			assert.That(t, rate(scaleSummaryBits(3, shift)) <= n>>shift*5/4+20)
+		}
+	})
+
+	t.Run("Filter", func(t *testing.T) {
+		cf, done := tempFilter(t, 32, Options{})
+		defer done()
+
+		// the hashes are spread over several levels past level 0.
+		var e []uint64
+		for len(cf.levels) < 6 || len(e) < 3<<14 {
+			x := pcg.Uint64()
+			e = append(e, x)
+			assert.NoError(t, cf.Add(x))
+		}
+
+		// a negative lookup probes under half of a level past level 0 in
+		// total.
+		probes := func(cf *casFilter) float64 {
+			n := 0
+			for i := 0; i < 10000; i++ {
+				x := pcg.Uint64()
+				for _, l := range cf.levels[1:] {
+					if !l.Empty() && l.sum.has(x) {
+						n++
+					}
+				}
+			}
+			return float64(n) / 10000
+		}
+		assert.That(t, probes(cf) < 0.6)
+
+		// the summaries take a few bits for every hash.
+		u, err := cf.Usage()
+		assert.NoError(t, err)
+		assert.That(t, u.Summary > 0)
+		assert.That(t, u.Summary <= int64(cf.Len())*5/8+8*int64(len(cf.levels)))
+		assert.NoError(t, cf.Close())
+
+		// the summaries are built in the background when the filter is
+		// opened, and the levels are probed until then.
+		cf2, err := OpenStorage(cf.st, Options{})
+		assert.NoError(t, err)
+		<-cf2.summarizing
+		assert.That(t, probes(cf2) < 0.6)
+		for _, v := range e {
+			ok, err := cf2.Lookup(v)
+			assert.NoError(t, err)
+			assert.That(t, ok)
+		}
+		assert.NoError(t, cf2.Close())
+	})
+
+	t.Run("Wide", func(t *testing.T) {
+		cf, done := tempFilter(t, 64, Options{Level0Bytes: 1 << 16})
+		defer done()
+
+		var e []uint64
+		for i := 0; i < 30000; i++ {
+			x := pcg.Uint64()
+			e = append(e, x)
+			assert.NoError(t, cf.Add(x))
+		}
+		assert.NoError(t, cf.Close())
+
+		// summarizing a level of 64 bit hashes does not wrap around.
+		cf2, err := OpenStorage(cf.st, Options{})
+		assert.NoError(t, err)
+		<-cf2.summarizing
+		for _, v := range e {
+			ok, err := cf2.Lookup(v)
+			assert.NoError(t, err)
+			assert.That(t, ok)
+		}
+		assert.NoError(t, cf2.Close())
+	})
+
+	t.Run("Open Writes", func(t *testing.T) {
+		for _, bg := range []bool{false, true} {
+			cf, done := tempFilter(t, 24, Options{})
+			defer done()
+
+			var e []uint64
+			for len(cf.levels) < 5 {
+				x := pcg.Uint64()
+				e = append(e, x)
+				assert.NoError(t, cf.Add(x))
+			}
+			assert.NoError(t, cf.Close())
+
+			// spills replace levels while they are being summarized, and
+			// every level ends up with a summary that has its hashes.
+			cf2, err := OpenStorage(cf.st, Options{Background: bg})
+			assert.NoError(t, err)
+			for i := 0; i < 20000; i++ {
+				x := pcg.Uint64()
+				e = append(e, x)
+				assert.NoError(t, cf2.Add(x))
+			}
+			<-cf2.summarizing
+			assert.NoError(t, cf2.Flush(context.Background()))
+
+			for _, l := range cf2.levels[1:] {
+				assert.That(t, l.Empty() || l.sum.ready())
+			}
+			for _, v := range e {
+				ok, err := cf2.Lookup(v)
+				assert.NoError(t, err)
+				assert.That(t, ok)
+			}
+			assert.NoError(t, cf2.Close())
+		}
+	})
+}